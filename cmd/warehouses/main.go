@@ -7,15 +7,20 @@ import (
 	"LamodaTest/internal/models"
 	"LamodaTest/internal/storage"
 	"LamodaTest/internal/web"
+	"LamodaTest/internal/worker"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 
 	_ "github.com/lib/pq"
 )
 
+// stockChangedChannel is the notification channel of warehouse_product changes, see the migrations
+const stockChangedChannel = "stock_changed"
+
 func main() {
 	if err := run(); err != nil {
 		log.Println(err.Error())
@@ -42,37 +47,65 @@ func run() error {
 
 	err = database.MigrateUp(config.DB)
 	if err != nil {
-		logger.Error("Error creating migrations", err.Error())
+		logger.Error("Error creating migrations", slog.String("error", err.Error()))
 		return err
 	}
 
-	ctx := context.TODO()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blockPolicy, err := models.ParseBlockPolicy(config.Warehouse.BlockPolicy)
+	if err != nil {
+		return err
+	}
 
-	st := storage.NewStorage(db)
+	st := storage.NewStorage(db, blockPolicy)
 
 	err = outputTestData(ctx, st)
 	if err != nil {
 		return err
 	}
 
-	server, err := web.New(config.Server, logger, st)
+	sweeper := worker.NewExpirySweeper(config.Reservation, logger, st)
+	go sweeper.Run(ctx)
+
+	snapshotter := worker.NewStockSnapshotter(config.Snapshot, logger, st)
+	go snapshotter.Run(ctx)
+
+	stockChanges, err := database.NewListener(config.DB, stockChangedChannel)
+	if err != nil {
+		return err
+	}
+	defer stockChanges.Close()
+
+	alerts := worker.NewStockAlertEvaluator(config.Alerts, logger, st, stockChanges.Notify)
+	go alerts.Run(ctx)
+
+	idempotencyCleaner := worker.NewIdempotencyCleaner(config.Idempotency, logger, st)
+	go idempotencyCleaner.Run(ctx)
+
+	server, err := web.New(config.Server, config.Reservation, config.Idempotency, blockPolicy, logger, st)
 	if err != nil {
 		return err
 	}
+	server.SetExpiryStats(sweeper)
 
 	return server.Serve()
 }
 
 func outputTestData(ctx context.Context, st *storage.Storage) error {
-	warehouses, err := st.GetWarehouses(ctx, models.GetWarehousesFilter{})
+	warehouses, _, err := st.GetWarehouses(ctx, models.GetWarehousesFilter{})
+	if err != nil {
+		return fmt.Errorf("error getting TestData %v", err)
+	}
+	products, _, err := st.GetProducts(ctx, models.GetProductsFilter{})
 	if err != nil {
 		return fmt.Errorf("error getting TestData %v", err)
 	}
-	products, err := st.GetProducts(ctx, models.GetProductsFilter{})
+	warehouseProducts, _, err := st.GetWP(ctx, models.GetWarehouseProductFilter{})
 	if err != nil {
 		return fmt.Errorf("error getting TestData %v", err)
 	}
-	warehouseProducts, err := st.GetWP(ctx, models.GetWarehouseProductFilter{})
 
 	for _, warehouse := range warehouses {
 		jsonData, err := json.MarshalIndent(warehouse, "", "  ")
@@ -0,0 +1,166 @@
+package allocation
+
+import (
+	"errors"
+	"sort"
+)
+
+type Strategy string
+
+const (
+	// MostAvailable takes stock from warehouses with the largest available quantity first
+	MostAvailable Strategy = "most_available"
+	// Priority takes stock from warehouses in order of their fixed priority
+	Priority Strategy = "priority"
+	// FewestSplits minimises the number of warehouses the whole order is shipped from
+	FewestSplits Strategy = "fewest_splits"
+)
+
+var ErrUnknownStrategy = errors.New("unknown allocation strategy")
+
+// Demand is a quantity of a product requested by a line of an order
+type Demand struct {
+	Line      int
+	ProductID int
+	Quantity  int
+}
+
+// Stock is a quantity of a product available for allocation in a warehouse
+type Stock struct {
+	WarehouseID int
+	ProductID   int
+	Priority    int
+	Available   int
+}
+
+// Allocation is a part of a demand assigned to a warehouse
+type Allocation struct {
+	Line        int
+	WarehouseID int
+	ProductID   int
+	Quantity    int
+}
+
+type stockKey struct {
+	warehouseID int
+	productID   int
+}
+
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "":
+		return MostAvailable, nil
+	case MostAvailable, Priority, FewestSplits:
+		return Strategy(s), nil
+	}
+	return "", ErrUnknownStrategy
+}
+
+// Allocate distributes demands over the stock according to the strategy.
+// Demands that can't be covered in full are allocated as far as possible,
+// the caller compares allocated quantities with the demands to find the shortage.
+func Allocate(strategy Strategy, demands []Demand, stock []Stock) ([]Allocation, error) {
+	available := make(map[stockKey]int, len(stock))
+	priorities := make(map[int]int)
+	for _, s := range stock {
+		if s.Available > 0 {
+			available[stockKey{s.WarehouseID, s.ProductID}] += s.Available
+		}
+		priorities[s.WarehouseID] = s.Priority
+	}
+
+	switch strategy {
+	case MostAvailable, Priority:
+		return allocateByLine(strategy, demands, available, priorities), nil
+	case FewestSplits:
+		return allocateFewestSplits(demands, available, priorities), nil
+	}
+	return nil, ErrUnknownStrategy
+}
+
+func allocateByLine(strategy Strategy, demands []Demand, available map[stockKey]int, priorities map[int]int) []Allocation {
+	var allocations []Allocation
+	for _, demand := range demands {
+		warehouses := warehousesWithProduct(demand.ProductID, available)
+		sort.Slice(warehouses, func(a, b int) bool {
+			wa, wb := warehouses[a], warehouses[b]
+			if strategy == MostAvailable {
+				qa, qb := available[stockKey{wa, demand.ProductID}], available[stockKey{wb, demand.ProductID}]
+				if qa != qb {
+					return qa > qb
+				}
+			}
+			if priorities[wa] != priorities[wb] {
+				return priorities[wa] < priorities[wb]
+			}
+			return wa < wb
+		})
+
+		remaining := demand.Quantity
+		for _, warehouseID := range warehouses {
+			if remaining == 0 {
+				break
+			}
+			key := stockKey{warehouseID, demand.ProductID}
+			quantity := min(remaining, available[key])
+			available[key] -= quantity
+			remaining -= quantity
+			allocations = append(allocations, Allocation{Line: demand.Line, WarehouseID: warehouseID, ProductID: demand.ProductID, Quantity: quantity})
+		}
+	}
+	return allocations
+}
+
+// allocateFewestSplits greedily picks the warehouse able to ship the most of the remaining order
+// until nothing more can be allocated
+func allocateFewestSplits(demands []Demand, available map[stockKey]int, priorities map[int]int) []Allocation {
+	var allocations []Allocation
+	remaining := make([]int, len(demands))
+	for i, demand := range demands {
+		remaining[i] = demand.Quantity
+	}
+
+	used := make(map[int]bool)
+	for {
+		best, bestCover := 0, 0
+		for warehouseID := range priorities {
+			if used[warehouseID] {
+				continue
+			}
+			cover := 0
+			for i, demand := range demands {
+				cover += min(remaining[i], available[stockKey{warehouseID, demand.ProductID}])
+			}
+			if cover > bestCover ||
+				cover == bestCover && cover > 0 && (priorities[warehouseID] < priorities[best] ||
+					priorities[warehouseID] == priorities[best] && warehouseID < best) {
+				best, bestCover = warehouseID, cover
+			}
+		}
+		if bestCover == 0 {
+			return allocations
+		}
+
+		used[best] = true
+		for i, demand := range demands {
+			key := stockKey{best, demand.ProductID}
+			quantity := min(remaining[i], available[key])
+			if quantity == 0 {
+				continue
+			}
+			available[key] -= quantity
+			remaining[i] -= quantity
+			allocations = append(allocations, Allocation{Line: demand.Line, WarehouseID: best, ProductID: demand.ProductID, Quantity: quantity})
+		}
+	}
+}
+
+func warehousesWithProduct(productID int, available map[stockKey]int) []int {
+	var warehouses []int
+	for key, quantity := range available {
+		if key.productID == productID && quantity > 0 {
+			warehouses = append(warehouses, key.warehouseID)
+		}
+	}
+	return warehouses
+}
@@ -0,0 +1,220 @@
+package allocation
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy Strategy
+		demands  []Demand
+		stock    []Stock
+		want     []Allocation
+	}{
+		{
+			name:     "most available takes the largest stock first",
+			strategy: MostAvailable,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 10}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 1, Available: 5},
+				{WarehouseID: 2, ProductID: 1, Priority: 2, Available: 8},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 2, ProductID: 1, Quantity: 8},
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 2},
+			},
+		},
+		{
+			name:     "most available breaks ties by priority, then by warehouse id",
+			strategy: MostAvailable,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 12}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 2, Available: 5},
+				{WarehouseID: 3, ProductID: 1, Priority: 1, Available: 5},
+				{WarehouseID: 2, ProductID: 1, Priority: 1, Available: 5},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 2, ProductID: 1, Quantity: 5},
+				{Line: 0, WarehouseID: 3, ProductID: 1, Quantity: 5},
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 2},
+			},
+		},
+		{
+			name:     "most available shares stock between lines of the same product",
+			strategy: MostAvailable,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 6}, {Line: 1, ProductID: 1, Quantity: 6}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 1, Available: 8},
+				{WarehouseID: 2, ProductID: 1, Priority: 1, Available: 4},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 6},
+				{Line: 1, WarehouseID: 2, ProductID: 1, Quantity: 4},
+				{Line: 1, WarehouseID: 1, ProductID: 1, Quantity: 2},
+			},
+		},
+		{
+			name:     "priority ignores quantities",
+			strategy: Priority,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 5}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 2, Available: 10},
+				{WarehouseID: 2, ProductID: 1, Priority: 1, Available: 3},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 2, ProductID: 1, Quantity: 3},
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 2},
+			},
+		},
+		{
+			name:     "priority breaks ties by warehouse id",
+			strategy: Priority,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 4}},
+			stock: []Stock{
+				{WarehouseID: 7, ProductID: 1, Priority: 1, Available: 10},
+				{WarehouseID: 4, ProductID: 1, Priority: 1, Available: 2},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 4, ProductID: 1, Quantity: 2},
+				{Line: 0, WarehouseID: 7, ProductID: 1, Quantity: 2},
+			},
+		},
+		{
+			name:     "fewest splits ships the whole order from one warehouse",
+			strategy: FewestSplits,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 5}, {Line: 1, ProductID: 2, Quantity: 5}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 1, Available: 5},
+				{WarehouseID: 2, ProductID: 1, Priority: 2, Available: 3},
+				{WarehouseID: 2, ProductID: 2, Priority: 2, Available: 3},
+				{WarehouseID: 3, ProductID: 1, Priority: 3, Available: 5},
+				{WarehouseID: 3, ProductID: 2, Priority: 3, Available: 5},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 3, ProductID: 1, Quantity: 5},
+				{Line: 1, WarehouseID: 3, ProductID: 2, Quantity: 5},
+			},
+		},
+		{
+			name:     "fewest splits adds the warehouse covering most of the rest",
+			strategy: FewestSplits,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 5}, {Line: 1, ProductID: 2, Quantity: 5}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 1, Available: 5},
+				{WarehouseID: 1, ProductID: 2, Priority: 1, Available: 1},
+				{WarehouseID: 2, ProductID: 2, Priority: 2, Available: 2},
+				{WarehouseID: 3, ProductID: 2, Priority: 3, Available: 4},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 5},
+				{Line: 1, WarehouseID: 1, ProductID: 2, Quantity: 1},
+				{Line: 1, WarehouseID: 3, ProductID: 2, Quantity: 4},
+			},
+		},
+		{
+			name:     "fewest splits breaks ties by priority, then by warehouse id",
+			strategy: FewestSplits,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 5}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 2, Available: 5},
+				{WarehouseID: 3, ProductID: 1, Priority: 1, Available: 5},
+				{WarehouseID: 2, ProductID: 1, Priority: 1, Available: 5},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 2, ProductID: 1, Quantity: 5},
+			},
+		},
+		{
+			name:     "most available allocates what there is when stock is insufficient",
+			strategy: MostAvailable,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 10}, {Line: 1, ProductID: 2, Quantity: 3}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 1, Available: 4},
+				{WarehouseID: 2, ProductID: 1, Priority: 1, Available: 2},
+				{WarehouseID: 2, ProductID: 2, Priority: 1, Available: 0},
+				{WarehouseID: 3, ProductID: 2, Priority: 1, Available: -1},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 4},
+				{Line: 0, WarehouseID: 2, ProductID: 1, Quantity: 2},
+			},
+		},
+		{
+			name:     "priority allocates what there is when stock is insufficient",
+			strategy: Priority,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 10}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 2, Available: 4},
+				{WarehouseID: 2, ProductID: 1, Priority: 1, Available: 2},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 2, ProductID: 1, Quantity: 2},
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 4},
+			},
+		},
+		{
+			name:     "fewest splits allocates what there is when stock is insufficient",
+			strategy: FewestSplits,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 10}, {Line: 1, ProductID: 2, Quantity: 3}},
+			stock: []Stock{
+				{WarehouseID: 1, ProductID: 1, Priority: 1, Available: 4},
+				{WarehouseID: 2, ProductID: 1, Priority: 1, Available: 2},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 1, ProductID: 1, Quantity: 4},
+				{Line: 0, WarehouseID: 2, ProductID: 1, Quantity: 2},
+			},
+		},
+		{
+			name:     "no stock allocates nothing",
+			strategy: FewestSplits,
+			demands:  []Demand{{Line: 0, ProductID: 1, Quantity: 1}},
+			stock:    []Stock{{WarehouseID: 1, ProductID: 2, Priority: 1, Available: 5}},
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Allocate(tt.strategy, tt.demands, tt.stock)
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Allocate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateUnknownStrategy(t *testing.T) {
+	_, err := Allocate("nearest", []Demand{{ProductID: 1, Quantity: 1}}, nil)
+	if !errors.Is(err, ErrUnknownStrategy) {
+		t.Errorf("Allocate() error = %v, want %v", err, ErrUnknownStrategy)
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Strategy
+		wantErr error
+	}{
+		{"", MostAvailable, nil},
+		{"most_available", MostAvailable, nil},
+		{"priority", Priority, nil},
+		{"fewest_splits", FewestSplits, nil},
+		{"Priority", "", ErrUnknownStrategy},
+		{"nearest", "", ErrUnknownStrategy},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseStrategy(tt.s)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("ParseStrategy(%q) = %q, %v, want %q, %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
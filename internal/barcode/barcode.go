@@ -0,0 +1,34 @@
+package barcode
+
+// Valid reports whether code is a GTIN-8, GTIN-12 (UPC-A), GTIN-13 (EAN-13) or GTIN-14
+// with a correct check digit
+func Valid(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+
+	for _, digit := range code {
+		if digit < '0' || digit > '9' {
+			return false
+		}
+	}
+
+	return int(code[len(code)-1]-'0') == CheckDigit(code[:len(code)-1])
+}
+
+// CheckDigit returns the GTIN check digit of the digits: their sum with weights 3 and 1 alternating
+// from the rightmost digit, subtracted from the nearest multiple of ten
+func CheckDigit(digits string) int {
+	sum := 0
+	for i := range digits {
+		weight := 1
+		if i%2 == 0 {
+			weight = 3
+		}
+		sum += int(digits[len(digits)-1-i]-'0') * weight
+	}
+
+	return (10 - sum%10) % 10
+}
@@ -0,0 +1,57 @@
+package barcode
+
+import "testing"
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"GTIN-8", "96385074", true},
+		{"GTIN-12", "036000291452", true},
+		{"GTIN-13", "4006381333931", true},
+		{"GTIN-14", "10012345678902", true},
+		{"zeros", "00000000", true},
+		{"GTIN-8 wrong check digit", "96385075", false},
+		{"GTIN-12 wrong check digit", "036000291453", false},
+		{"GTIN-13 wrong check digit", "4006381333932", false},
+		{"GTIN-14 wrong check digit", "10012345678903", false},
+		{"empty", "", false},
+		{"too short", "9638507", false},
+		{"between lengths", "9638507400", false},
+		{"too long", "100123456789020", false},
+		{"letter", "400638133393A", false},
+		{"space", "4006381 33931", false},
+		{"sign", "+4006381333931", false},
+		{"non-ASCII digit", "400638133393١", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.code); got != tt.want {
+				t.Errorf("Valid(%q) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   int
+	}{
+		{"9638507", 4},
+		{"03600029145", 2},
+		{"400638133393", 1},
+		{"1001234567890", 2},
+		{"460005100005", 7},
+		{"0000000", 0},
+	}
+
+	for _, tt := range tests {
+		if got := CheckDigit(tt.digits); got != tt.want {
+			t.Errorf("CheckDigit(%q) = %d, want %d", tt.digits, got, tt.want)
+		}
+	}
+}
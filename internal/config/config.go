@@ -3,6 +3,7 @@ package config
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"time"
 )
 
 type DB struct {
@@ -24,10 +25,46 @@ type Server struct {
 	URL string `yaml:"url"`
 }
 
+type Reservation struct {
+	DefaultTTL     time.Duration `yaml:"default_ttl"`
+	SweepInterval  time.Duration `yaml:"sweep_interval"`
+	SweepBatchSize int           `yaml:"sweep_batch_size"`
+}
+
+// Snapshot configures daily stock snapshots. The snapshot of a day is taken
+// no earlier than Delay after midnight, when transactions of the day are committed
+type Snapshot struct {
+	Interval time.Duration `yaml:"interval"`
+	Delay    time.Duration `yaml:"delay"`
+}
+
+// Alerts configures the stock alert evaluator. Stock changes are evaluated right after their commit,
+// Interval bounds the delay of alerts when change notifications are lost, e.g. while the listener reconnects
+type Alerts struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Idempotency configures stored idempotent responses. Keys are kept for TTL, a request still
+// in progress after InProgressTimeout is taken as abandoned and can be retried with the same key
+type Idempotency struct {
+	TTL               time.Duration `yaml:"ttl"`
+	InProgressTimeout time.Duration `yaml:"in_progress_timeout"`
+	CleanupInterval   time.Duration `yaml:"cleanup_interval"`
+}
+
+type Warehouse struct {
+	BlockPolicy string `yaml:"block_policy"`
+}
+
 type AppConfig struct {
-	DB     DB     `yaml:"database"`
-	Logger Logger `yaml:"logger"`
-	Server Server `yaml:"server"`
+	DB          DB          `yaml:"database"`
+	Logger      Logger      `yaml:"logger"`
+	Server      Server      `yaml:"server"`
+	Reservation Reservation `yaml:"reservation"`
+	Warehouse   Warehouse   `yaml:"warehouse"`
+	Snapshot    Snapshot    `yaml:"snapshot"`
+	Alerts      Alerts      `yaml:"alerts"`
+	Idempotency Idempotency `yaml:"idempotency"`
 }
 
 func NewConfig(path string) (*AppConfig, error) {
@@ -5,10 +5,18 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/lib/pq"
+)
+
+// Reconnect intervals of listeners
+const (
+	listenerMinReconnectInterval = 10 * time.Second
+	listenerMaxReconnectInterval = time.Minute
 )
 
 func Connection(config config.DB) (*sql.DB, error) {
@@ -26,6 +34,19 @@ func Connection(config config.DB) (*sql.DB, error) {
 	return db, nil
 }
 
+// NewListener opens a connection that receives notifications of the given channel.
+// A nil notification is sent after a reconnect, notifications of the gap are lost then
+func NewListener(config config.DB, channel string) (*pq.Listener, error) {
+	connectionString := fmt.Sprintf("postgres://%v:%v@%v:%v/%v?sslmode=disable", config.User, config.Password, config.Host, config.Port, config.Name)
+	listener := pq.NewListener(connectionString, listenerMinReconnectInterval, listenerMaxReconnectInterval, nil)
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
 func MigrateUp(config config.DB) error {
 	connectionString := fmt.Sprintf("postgres://%v:%v@%v:%v/%v?sslmode=disable", config.User, config.Password, config.Host, config.Port, config.Name)
 	m, err := migrate.New(
@@ -1,20 +1,69 @@
 package models
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
 // Warehouse represents model for warehouses table
 type Warehouse struct {
 	ID           int    `json:"id"`
 	Name         string `json:"name"`
 	Availability bool   `json:"availability"`
+	Priority     int    `json:"priority"`
+
+	// SafetyStock is the default number of units per product that reservations can't take
+	SafetyStock int `json:"safety_stock"`
+}
+
+// BlockPolicy defines what happens to reservations when a warehouse is blocked
+type BlockPolicy string
+
+const (
+	// BlockPolicyKeep keeps accepting reservations in blocked warehouses
+	BlockPolicyKeep BlockPolicy = "keep"
+	// BlockPolicyRejectNew rejects new reservations and keeps the existing ones
+	BlockPolicyRejectNew BlockPolicy = "reject_new"
+	// BlockPolicyMove rejects new reservations and moves the existing ones to other warehouses
+	BlockPolicyMove BlockPolicy = "move"
+)
+
+func ParseBlockPolicy(s string) (BlockPolicy, error) {
+	switch BlockPolicy(s) {
+	case "":
+		return BlockPolicyRejectNew, nil
+	case BlockPolicyKeep, BlockPolicyRejectNew, BlockPolicyMove:
+		return BlockPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown warehouse block policy %q", s)
+}
+
+// PageFilter is keyset pagination of a list: at most Limit rows sorted by Sort, starting after the row of Cursor.
+// Sort is a sort field of the list, prefixed with "-" for descending order, rows with equal values are sorted by id.
+// Cursor is returned by the previous page and is only valid with the same Sort. Zero Limit returns every row
+type PageFilter struct {
+	Limit  int    `json:"limit,omitempty"`
+	Sort   string `json:"sort,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
 }
 
+// GetWarehousesFilter with Name matches warehouses whose name contains it, case-insensitively.
+// Warehouses can be sorted by id, name and priority
 type GetWarehousesFilter struct {
-	IDs []int `json:"ID,omitempty"`
+	IDs          []int  `json:"ID,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Availability *bool  `json:"availability,omitempty"`
+
+	Page PageFilter `json:"page"`
 }
 
 type UpdateWarehouseInput struct {
 	ID           int     `json:"id"`
 	Name         *string `json:"name"`
 	Availability *bool   `json:"availability"`
+	Priority     *int    `json:"priority"`
+	SafetyStock  *int    `json:"safety_stock"`
 }
 
 type DeleteWarehouseInput struct {
@@ -22,30 +71,135 @@ type DeleteWarehouseInput struct {
 }
 
 // Product represents model for products table
+// Code is the SKU of the product. A product with StyleID is a variant of the style with its size and color
 type Product struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
 	Size string `json:"size"`
 	Code string `json:"code"`
+
+	StyleID *int   `json:"style_id"`
+	Color   string `json:"color"`
+
+	// Unit is the base unit of measure, stock quantities of the product are counted in it
+	Unit string `json:"unit"`
 }
 
+// GetProductsFilter with Name matches products whose name contains it, case-insensitively.
+// Products can be sorted by id, name, size and code
 type GetProductsFilter struct {
-	IDs   []int    `json:"IDs,omitempty"`
-	Codes []string `json:"code,omitempty"`
+	IDs      []int    `json:"IDs,omitempty"`
+	Codes    []string `json:"code,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Size     string   `json:"size,omitempty"`
+	Color    string   `json:"color,omitempty"`
+	StyleIDs []int    `json:"style_ids,omitempty"`
+
+	Page PageFilter `json:"page"`
 }
 
+// SearchProductsFilter finds products by a partial or mistyped name or code.
+// With InStockWarehouseID only products with reservable stock in that warehouse are found
+type SearchProductsFilter struct {
+	Query              string `json:"query"`
+	InStockWarehouseID int    `json:"in_stock_warehouse_id,omitempty"`
+	Limit              int    `json:"limit,omitempty"`
+}
+
+// ProductSearchResult is a product found by the search, results with higher Rank match better
+type ProductSearchResult struct {
+	Product
+	Rank float64 `json:"rank"`
+}
+
+// UpdateProductInput with ResetStyle makes the product standalone
 type UpdateProductInput struct {
 	ID int `json:"id"`
 
-	Name *string `json:"name"`
-	Size *string `json:"size"`
-	Code *string `json:"code"`
+	Name    *string `json:"name"`
+	Size    *string `json:"size"`
+	Code    *string `json:"code"`
+	StyleID *int    `json:"style_id"`
+	Color   *string `json:"color"`
+	Unit    *string `json:"unit"`
+
+	ResetStyle bool `json:"reset_style"`
 }
 
 type DeleteProductInput struct {
 	ID int
 }
 
+// ProductPack represents model for product_packs table, a pack holds Quantity base units of the product
+type ProductPack struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name"`
+	Quantity  int    `json:"quantity"`
+}
+
+// ProductBarcode represents model for product_barcodes table
+type ProductBarcode struct {
+	Barcode   string    `json:"barcode"`
+	ProductID int       `json:"product_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type GetBarcodesFilter struct {
+	Barcodes   []string `json:"barcodes,omitempty"`
+	ProductIDs []int    `json:"product_ids,omitempty"`
+}
+
+// Style represents model for styles table: a product article with its variants.
+// SizeGrid names the size system of the variants, like EU or INT
+type Style struct {
+	ID       int    `json:"id"`
+	Article  string `json:"article"`
+	Name     string `json:"name"`
+	SizeGrid string `json:"size_grid"`
+
+	Variants []*Product `json:"variants,omitempty"`
+}
+
+// GetStylesFilter with Name matches styles whose name contains it, case-insensitively.
+// Styles can be sorted by id, article and name
+type GetStylesFilter struct {
+	IDs      []int    `json:"IDs,omitempty"`
+	Articles []string `json:"articles,omitempty"`
+	Name     string   `json:"name,omitempty"`
+
+	Page PageFilter `json:"page"`
+}
+
+type UpdateStyleInput struct {
+	ID int `json:"id"`
+
+	Article  *string `json:"article"`
+	Name     *string `json:"name"`
+	SizeGrid *string `json:"size_grid"`
+}
+
+type DeleteStyleInput struct {
+	ID int
+}
+
+// StyleStock is the stock of all variants of a style in a warehouse
+type StyleStock struct {
+	StyleID          int    `json:"style_id"`
+	Article          string `json:"article"`
+	WarehouseID      int    `json:"warehouse_id"`
+	Variants         int    `json:"variants"`
+	Quantity         int    `json:"quantity"`
+	ReservedQuantity int    `json:"reserved_quantity"`
+	Available        int    `json:"available"`
+	Reservable       int    `json:"reservable"`
+}
+
+// GetStyleStockFilter with zero WarehouseID returns the stock of the styles in every warehouse
+type GetStyleStockFilter struct {
+	StyleIDs    []int `json:"style_ids,omitempty"`
+	WarehouseID int   `json:"warehouse_id,omitempty"`
+}
+
 // WarehouseProduct represents model for warehouse_product table
 type WarehouseProduct struct {
 	ID               int `json:"id"`
@@ -53,12 +207,31 @@ type WarehouseProduct struct {
 	ProductID        int `json:"product_id"`
 	Quantity         int `json:"quantity"`
 	ReservedQuantity int `json:"reserved_quantity"`
+
+	// InTransitQuantity is dispatched to the warehouse by transfers and not yet received
+	InTransitQuantity int `json:"in_transit_quantity"`
+
+	// MinLevel and ReorderPoint are thresholds of available stock for low-stock alerts, zero disables them
+	MinLevel     int `json:"min_level"`
+	ReorderPoint int `json:"reorder_point"`
+
+	// SafetyStock overrides the safety stock of the warehouse when not nil.
+	// Reservable is quantity - reserved_quantity - safety stock, computed on read
+	SafetyStock *int `json:"safety_stock"`
+	Reservable  int  `json:"reservable"`
 }
 
+// GetWarehouseProductFilter with MinAvailable matches rows with at least that reservable stock (quantity - reserved_quantity - safety_stock),
+// with Availability - rows of available or blocked warehouses.
+// Rows can be sorted by id, quantity, reserved_quantity, available and reservable
 type GetWarehouseProductFilter struct {
-	IDs         []int `json:"IDs,omitempty"`
-	WarehouseID int   `json:"WarehouseID,omitempty"`
-	ProductID   int   `json:"ProductID,omitempty"`
+	IDs          []int `json:"IDs,omitempty"`
+	WarehouseID  int   `json:"WarehouseID,omitempty"`
+	ProductID    int   `json:"ProductID,omitempty"`
+	MinAvailable *int  `json:"MinAvailable,omitempty"`
+	Availability *bool `json:"Availability,omitempty"`
+
+	Page PageFilter `json:"page"`
 }
 
 type GetWPByProductCodeFilter struct {
@@ -73,6 +246,12 @@ type UpdateWarehouseProductInput struct {
 	ProductID        *int `json:"product_id"`
 	Quantity         *int `json:"quantity"`
 	ReservedQuantity *int `json:"reserved_quantity"`
+	MinLevel         *int `json:"min_level"`
+	ReorderPoint     *int `json:"reorder_point"`
+	SafetyStock      *int `json:"safety_stock"`
+
+	// ResetSafetyStock makes the product use the safety stock of the warehouse again
+	ResetSafetyStock bool `json:"reset_safety_stock"`
 }
 
 type DeleteWarehouseProductInput struct {
@@ -81,6 +260,443 @@ type DeleteWarehouseProductInput struct {
 	ProductID   []int `json:"ProductIDs,omitempty"`
 }
 
+// StockLine represents a quantity of a product in a warehouse for stock operations.
+// The product is given by ProductID, Barcode or Code, in this order.
+// Quantity is in base units, a line given in packs keeps the decimal number of packs in Packs until it's converted
+type StockLine struct {
+	WarehouseID int    `json:"warehouse_id"`
+	ProductID   int    `json:"product_id"`
+	Code        string `json:"code"`
+	Barcode     string `json:"barcode,omitempty"`
+	Quantity    int    `json:"quantity"`
+	Pack        string `json:"pack,omitempty"`
+	Packs       string `json:"packs,omitempty"`
+}
+
+const (
+	ReasonNotFound             = "not_found"
+	ReasonInsufficientStock    = "insufficient_stock"
+	ReasonInsufficientReserve  = "insufficient_reserve"
+	ReasonWarehouseUnavailable = "warehouse_unavailable"
+	ReasonExceedsReservation   = "exceeds_reservation"
+	ReasonBelowReserved        = "below_reserved"
+	ReasonFractionalQuantity   = "fractional_quantity"
+	ReasonInvalidQuantity      = "invalid_quantity"
+)
+
+type FailedStockLine struct {
+	StockLine
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// StockLineResult represents the outcome of reserving a single stock line
+type StockLineResult struct {
+	WarehouseID int    `json:"warehouse_id"`
+	ProductID   int    `json:"product_id"`
+	Code        string `json:"code"`
+	Barcode     string `json:"barcode,omitempty"`
+	Requested   int    `json:"requested"`
+	Reserved    int    `json:"reserved"`
+	Backordered int    `json:"backordered,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+
+	Allocations []StockAllocation `json:"allocations,omitempty"`
+}
+
+// StockAllocation represents the part of a line reserved in a warehouse
+type StockAllocation struct {
+	WarehouseID int `json:"warehouse_id"`
+	Quantity    int `json:"quantity"`
+}
+
+type ReserveMode string
+
+const (
+	ReserveAllOrNothing ReserveMode = "all_or_nothing"
+	ReservePartial      ReserveMode = "partial"
+)
+
+type ReservationStatus string
+
+const (
+	ReservationActive    ReservationStatus = "active"
+	ReservationReleased  ReservationStatus = "released"
+	ReservationFulfilled ReservationStatus = "fulfilled"
+	ReservationExpired   ReservationStatus = "expired"
+)
+
+// Reservation represents model for reservations table
+type Reservation struct {
+	ID         int               `json:"id"`
+	OrderRef   string            `json:"order_ref"`
+	Status     ReservationStatus `json:"status"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	ExpiresAt  *time.Time        `json:"expires_at"`
+	Lines      []ReservationLine `json:"lines"`
+	Backorders []Backorder       `json:"backorders,omitempty"`
+}
+
+// ReservationLine represents model for reservation_lines table
+type ReservationLine struct {
+	ID              int `json:"id"`
+	ReservationID   int `json:"reservation_id"`
+	WarehouseID     int `json:"warehouse_id"`
+	ProductID       int `json:"product_id"`
+	Quantity        int `json:"quantity"`
+	ShippedQuantity int `json:"shipped_quantity"`
+}
+
+// CreateReservationInput with Backorder queues the unmet quantities of warehouse-bound lines
+// as backorders of the reservation
+type CreateReservationInput struct {
+	OrderRef  string        `json:"order_ref"`
+	TTL       time.Duration `json:"ttl"`
+	Mode      ReserveMode   `json:"mode"`
+	Strategy  string        `json:"strategy"`
+	Backorder bool          `json:"backorder"`
+	Lines     []StockLine   `json:"lines"`
+}
+
+type BackorderStatus string
+
+const (
+	BackorderPending   BackorderStatus = "pending"
+	BackorderFilled    BackorderStatus = "filled"
+	BackorderCancelled BackorderStatus = "cancelled"
+)
+
+// Backorder represents model for backorders table.
+// Filled quantities are added to the reservation as reservation lines
+type Backorder struct {
+	ID             int             `json:"id"`
+	ReservationID  int             `json:"reservation_id"`
+	WarehouseID    int             `json:"warehouse_id"`
+	ProductID      int             `json:"product_id"`
+	Quantity       int             `json:"quantity"`
+	FilledQuantity int             `json:"filled_quantity"`
+	Status         BackorderStatus `json:"status"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+type GetReservationsFilter struct {
+	IDs      []int               `json:"IDs,omitempty"`
+	OrderRef string              `json:"OrderRef,omitempty"`
+	Statuses []ReservationStatus `json:"Statuses,omitempty"`
+}
+
+// Shipment represents model for shipments table
+type Shipment struct {
+	ID            int            `json:"id"`
+	ReservationID int            `json:"reservation_id"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Lines         []ShipmentLine `json:"lines"`
+}
+
+// ShipmentLine represents model for shipment_lines table
+type ShipmentLine struct {
+	ID          int `json:"id"`
+	ShipmentID  int `json:"shipment_id"`
+	WarehouseID int `json:"warehouse_id"`
+	ProductID   int `json:"product_id"`
+	Quantity    int `json:"quantity"`
+}
+
+// CreateShipmentInput ships the given lines of a reservation, or everything not yet shipped if Lines is empty
+type CreateShipmentInput struct {
+	ReservationID int         `json:"reservation_id"`
+	Lines         []StockLine `json:"lines"`
+}
+
+type GetShipmentsFilter struct {
+	IDs           []int `json:"IDs,omitempty"`
+	ReservationID int   `json:"ReservationID,omitempty"`
+}
+
+// Receipt represents model for receipts table
+type Receipt struct {
+	ID          int           `json:"id"`
+	Number      string        `json:"number"`
+	WarehouseID int           `json:"warehouse_id"`
+	SupplierRef string        `json:"supplier_ref"`
+	CreatedAt   time.Time     `json:"created_at"`
+	Lines       []ReceiptLine `json:"lines"`
+}
+
+// ReceiptLine represents model for receipt_lines table
+type ReceiptLine struct {
+	ID        int `json:"id"`
+	ReceiptID int `json:"receipt_id"`
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// CreateReceiptInput receives the lines into the warehouse. Number identifies the receipt,
+// a receipt with an already received number is not applied again
+type CreateReceiptInput struct {
+	Number      string      `json:"number"`
+	WarehouseID int         `json:"warehouse_id"`
+	SupplierRef string      `json:"supplier_ref"`
+	Lines       []StockLine `json:"lines"`
+}
+
+type GetReceiptsFilter struct {
+	IDs     []int    `json:"IDs,omitempty"`
+	Numbers []string `json:"Numbers,omitempty"`
+}
+
+type TransferStatus string
+
+const (
+	TransferCreated    TransferStatus = "created"
+	TransferDispatched TransferStatus = "dispatched"
+	TransferReceived   TransferStatus = "received"
+	TransferCancelled  TransferStatus = "cancelled"
+)
+
+// Transfer represents model for transfers table
+type Transfer struct {
+	ID                     int            `json:"id"`
+	SourceWarehouseID      int            `json:"source_warehouse_id"`
+	DestinationWarehouseID int            `json:"destination_warehouse_id"`
+	Status                 TransferStatus `json:"status"`
+	CreatedAt              time.Time      `json:"created_at"`
+	UpdatedAt              time.Time      `json:"updated_at"`
+	Lines                  []TransferLine `json:"lines"`
+}
+
+// TransferLine represents model for transfer_lines table
+type TransferLine struct {
+	ID         int `json:"id"`
+	TransferID int `json:"transfer_id"`
+	ProductID  int `json:"product_id"`
+	Quantity   int `json:"quantity"`
+}
+
+type CreateTransferInput struct {
+	SourceWarehouseID      int         `json:"source_warehouse_id"`
+	DestinationWarehouseID int         `json:"destination_warehouse_id"`
+	Lines                  []StockLine `json:"lines"`
+}
+
+type GetTransfersFilter struct {
+	IDs      []int            `json:"IDs,omitempty"`
+	Statuses []TransferStatus `json:"Statuses,omitempty"`
+}
+
+type MovementType string
+
+const (
+	MovementReserve  MovementType = "reserve"
+	MovementRelease  MovementType = "release"
+	MovementReceive  MovementType = "receive"
+	MovementShip     MovementType = "ship"
+	MovementAdjust   MovementType = "adjust"
+	MovementTransfer MovementType = "transfer"
+)
+
+// StockMovement represents model for stock_movements table, a change of a warehouse_product row
+type StockMovement struct {
+	ID             int64        `json:"id"`
+	WarehouseID    int          `json:"warehouse_id"`
+	ProductID      int          `json:"product_id"`
+	Type           MovementType `json:"type"`
+	QuantityDelta  int          `json:"quantity_delta"`
+	ReservedDelta  int          `json:"reserved_delta"`
+	InTransitDelta int          `json:"in_transit_delta"`
+	Reason         string       `json:"reason,omitempty"`
+	Actor          string       `json:"actor"`
+	RequestID      string       `json:"request_id"`
+	CreatedAt      time.Time    `json:"created_at"`
+}
+
+type GetStockMovementsFilter struct {
+	WarehouseID int            `json:"WarehouseID,omitempty"`
+	ProductID   int            `json:"ProductID,omitempty"`
+	ProductCode string         `json:"ProductCode,omitempty"`
+	Types       []MovementType `json:"Types,omitempty"`
+	From        *time.Time     `json:"From,omitempty"`
+	To          *time.Time     `json:"To,omitempty"`
+
+	Page PageFilter `json:"page"`
+}
+
+type AdjustmentReason string
+
+const (
+	AdjustmentDamage          AdjustmentReason = "damage"
+	AdjustmentLoss            AdjustmentReason = "loss"
+	AdjustmentCountCorrection AdjustmentReason = "count_correction"
+)
+
+// ParseAdjustmentReason validates a reason code, empty reason means a count correction
+func ParseAdjustmentReason(s string) (AdjustmentReason, error) {
+	switch reason := AdjustmentReason(s); reason {
+	case "":
+		return AdjustmentCountCorrection, nil
+	case AdjustmentDamage, AdjustmentLoss, AdjustmentCountCorrection:
+		return reason, nil
+	default:
+		return "", fmt.Errorf("unknown adjustment reason %q", s)
+	}
+}
+
+// StockAdjustment changes quantity of the line by Quantity, which is negative for write-offs
+type StockAdjustment struct {
+	StockLine
+	Reason AdjustmentReason `json:"reason"`
+}
+
+type StocktakeStatus string
+
+const (
+	StocktakeOpen      StocktakeStatus = "open"
+	StocktakeApplied   StocktakeStatus = "applied"
+	StocktakeCancelled StocktakeStatus = "cancelled"
+)
+
+// Stocktake represents model for stocktakes table, a count session of a warehouse
+type Stocktake struct {
+	ID          int             `json:"id"`
+	WarehouseID int             `json:"warehouse_id"`
+	Status      StocktakeStatus `json:"status"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	Lines       []StocktakeLine `json:"lines"`
+}
+
+// StocktakeLine represents model for stocktake_lines table
+type StocktakeLine struct {
+	ID              int              `json:"id"`
+	StocktakeID     int              `json:"stocktake_id"`
+	ProductID       int              `json:"product_id"`
+	CountedQuantity int              `json:"counted_quantity"`
+	Reason          AdjustmentReason `json:"reason"`
+}
+
+// StocktakeCount is a counted quantity of a product, a repeated count of the product replaces the previous one
+type StocktakeCount struct {
+	Code     string           `json:"code"`
+	Quantity int              `json:"quantity"`
+	Reason   AdjustmentReason `json:"reason"`
+}
+
+type SubmitStocktakeCountsInput struct {
+	StocktakeID int              `json:"stocktake_id"`
+	Counts      []StocktakeCount `json:"counts"`
+}
+
+// StocktakeVariance compares a counted quantity with the current stock
+type StocktakeVariance struct {
+	ProductID        int              `json:"product_id"`
+	Code             string           `json:"code"`
+	CountedQuantity  int              `json:"counted_quantity"`
+	Quantity         int              `json:"quantity"`
+	ReservedQuantity int              `json:"reserved_quantity"`
+	Variance         int              `json:"variance"`
+	Reason           AdjustmentReason `json:"reason"`
+}
+
+type GetStocktakesFilter struct {
+	IDs         []int             `json:"IDs,omitempty"`
+	WarehouseID int               `json:"WarehouseID,omitempty"`
+	Statuses    []StocktakeStatus `json:"Statuses,omitempty"`
+}
+
+type AlertLevel string
+
+const (
+	// AlertReorder means available stock is below the reorder point
+	AlertReorder AlertLevel = "reorder"
+	// AlertCritical means available stock is below the min level
+	AlertCritical AlertLevel = "critical"
+)
+
+// StockKey identifies the stock of a product in a warehouse
+type StockKey struct {
+	WarehouseID int `json:"warehouse_id"`
+	ProductID   int `json:"product_id"`
+}
+
+// StockAlert represents model for stock_alerts table. Available is the reservable stock when the alert was raised.
+// An alert is open until reservable stock is back at its thresholds, ResolvedAt is set then
+type StockAlert struct {
+	ID          int        `json:"id"`
+	WarehouseID int        `json:"warehouse_id"`
+	ProductID   int        `json:"product_id"`
+	Level       AlertLevel `json:"level"`
+	Available   int        `json:"available"`
+	Threshold   int        `json:"threshold"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ResolvedAt  *time.Time `json:"resolved_at"`
+}
+
+type GetStockAlertsFilter struct {
+	WarehouseID int  `json:"WarehouseID,omitempty"`
+	OnlyOpen    bool `json:"OnlyOpen,omitempty"`
+}
+
+// LowStockItem is a warehouse product whose reservable stock is below its thresholds
+type LowStockItem struct {
+	WarehouseID      int        `json:"warehouse_id"`
+	ProductID        int        `json:"product_id"`
+	Code             string     `json:"code"`
+	Quantity         int        `json:"quantity"`
+	ReservedQuantity int        `json:"reserved_quantity"`
+	Available        int        `json:"available"`
+	Reservable       int        `json:"reservable"`
+	MinLevel         int        `json:"min_level"`
+	ReorderPoint     int        `json:"reorder_point"`
+	Level            AlertLevel `json:"level"`
+}
+
+const EventBackorderFilled = "backorder.filled"
+
+// Event represents model for events table, the outbox of notification events
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// BackorderFilledEvent is the payload of EventBackorderFilled, Remaining is zero when the backorder is filled in full
+type BackorderFilledEvent struct {
+	BackorderID   int `json:"backorder_id"`
+	ReservationID int `json:"reservation_id"`
+	WarehouseID   int `json:"warehouse_id"`
+	ProductID     int `json:"product_id"`
+	Quantity      int `json:"quantity"`
+	Remaining     int `json:"remaining"`
+}
+
+type GetEventsFilter struct {
+	AfterID int64    `json:"AfterID,omitempty"`
+	Types   []string `json:"Types,omitempty"`
+	Limit   int      `json:"Limit,omitempty"`
+}
+
+// IdempotencyKey represents model for idempotency_keys table.
+// StatusCode is zero while the original request is still in progress, Owner is the ID of the request holding the key
+type IdempotencyKey struct {
+	Key         string    `json:"key"`
+	Owner       string    `json:"owner"`
+	RequestHash string    `json:"request_hash"`
+	StatusCode  int       `json:"status_code"`
+	Response    []byte    `json:"response"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type UpdateIdempotencyKeyInput struct {
+	Key        string `json:"key"`
+	Owner      string `json:"owner"`
+	StatusCode int    `json:"status_code"`
+	Response   []byte `json:"response"`
+}
+
 type ReserveDTO struct {
 	Reservations []Reserve `json:"reservations"`
 	WarehouseID  int       `json:"warehouse_id"`
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+// alertLevelExpr is the alert level of the warehouse_product row given by table below its thresholds
+func alertLevelExpr(table string) string {
+	return fmt.Sprintf("CASE WHEN %[2]s < %[1]s.min_level THEN 'critical' ELSE 'reorder' END", table, reservableExpr(table))
+}
+
+// alertThresholdExpr is the threshold of the alert level of the warehouse_product row given by table
+func alertThresholdExpr(table string) string {
+	return fmt.Sprintf("CASE WHEN %[2]s < %[1]s.min_level THEN %[1]s.min_level ELSE %[1]s.reorder_point END", table, reservableExpr(table))
+}
+
+// lowStockCondition matches rows of the warehouse_product table given by table whose reservable stock is below a threshold
+func lowStockCondition(table string) string {
+	return fmt.Sprintf("GREATEST(%[1]s.min_level, %[1]s.reorder_point) > 0 AND %[2]s < GREATEST(%[1]s.min_level, %[1]s.reorder_point)",
+		table, reservableExpr(table))
+}
+
+type AlertRepo struct {
+	db *sql.DB
+}
+
+func NewAlertRepo(db *sql.DB) *AlertRepo {
+	return &AlertRepo{
+		db: db,
+	}
+}
+
+// EvaluateStockAlerts compares available stock of the warehouse products given by keys, or of every one
+// without keys, with their thresholds. It opens alerts for products that dropped below a threshold,
+// changes the level of open alerts that crossed the other threshold and resolves alerts of products
+// that are back at their thresholds.
+func (r *AlertRepo) EvaluateStockAlerts(ctx context.Context, keys []models.StockKey) ([]*models.StockAlert, []*models.StockAlert, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	var warehouseIDs, productIDs []int64
+	if len(keys) > 0 {
+		warehouseIDs, productIDs = make([]int64, len(keys)), make([]int64, len(keys))
+		for i, key := range keys {
+			warehouseIDs[i], productIDs[i] = int64(key.WarehouseID), int64(key.ProductID)
+		}
+	}
+	args := []interface{}{pq.Array(warehouseIDs), pq.Array(productIDs)}
+
+	raised, err := queryStockAlertsTx(ctx, tx, fmt.Sprintf(`INSERT INTO stock_alerts (warehouse_id, product_id, level, available, threshold)
+		SELECT warehouse_id, product_id, %s, %s, %s
+		FROM warehouse_product
+		WHERE %s AND %s
+		ON CONFLICT (warehouse_id, product_id) WHERE resolved_at IS NULL
+		DO UPDATE SET level = EXCLUDED.level, available = EXCLUDED.available, threshold = EXCLUDED.threshold, updated_at = NOW()
+		WHERE stock_alerts.level <> EXCLUDED.level
+		RETURNING %s`, alertLevelExpr("warehouse_product"), reservableExpr("warehouse_product"), alertThresholdExpr("warehouse_product"),
+		lowStockCondition("warehouse_product"), stockKeysCondition(""), stockAlertColumns), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolved, err := queryStockAlertsTx(ctx, tx, fmt.Sprintf(`UPDATE stock_alerts a SET resolved_at = NOW(), updated_at = NOW()
+		WHERE a.resolved_at IS NULL AND %s AND NOT EXISTS (
+			SELECT 1 FROM warehouse_product
+			WHERE warehouse_id = a.warehouse_id AND product_id = a.product_id AND %s
+		)
+		RETURNING %s`, stockKeysCondition("a."), lowStockCondition("warehouse_product"), stockAlertColumns), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return raised, resolved, nil
+}
+
+// stockKeysCondition matches rows whose warehouse and product are the pairs of the arrays $1 and $2,
+// a NULL $1 matches every row. prefix qualifies the columns
+func stockKeysCondition(prefix string) string {
+	return fmt.Sprintf("($1::int[] IS NULL OR (%[1]swarehouse_id, %[1]sproduct_id) IN (SELECT * FROM unnest($1::int[], $2::int[])))", prefix)
+}
+
+const stockAlertColumns = "id, warehouse_id, product_id, level, available, threshold, created_at, updated_at, resolved_at"
+
+func queryStockAlertsTx(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]*models.StockAlert, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate stock alerts: %w", err)
+	}
+
+	return scanStockAlerts(rows)
+}
+
+func scanStockAlerts(rows *sql.Rows) ([]*models.StockAlert, error) {
+	defer rows.Close()
+
+	var alerts []*models.StockAlert
+	for rows.Next() {
+		var alert models.StockAlert
+		if err := rows.Scan(&alert.ID, &alert.WarehouseID, &alert.ProductID, &alert.Level, &alert.Available, &alert.Threshold,
+			&alert.CreatedAt, &alert.UpdatedAt, &alert.ResolvedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan stock alerts: %w", err)
+		}
+		alerts = append(alerts, &alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+func (r *AlertRepo) GetStockAlerts(ctx context.Context, filter models.GetStockAlertsFilter) ([]*models.StockAlert, error) {
+	queryBuilder := squirrel.Select(stockAlertColumns).From("stock_alerts").OrderBy("id").PlaceholderFormat(squirrel.Dollar)
+	if filter.WarehouseID != 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"warehouse_id": filter.WarehouseID})
+	}
+	if filter.OnlyOpen {
+		queryBuilder = queryBuilder.Where("resolved_at IS NULL")
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stock alerts: %w", err)
+	}
+
+	return scanStockAlerts(rows)
+}
+
+// GetLowStock returns products of the warehouse whose reservable stock is currently below their thresholds
+func (r *AlertRepo) GetLowStock(ctx context.Context, warehouseID int) ([]*models.LowStockItem, error) {
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf(`SELECT wp.warehouse_id, wp.product_id, p.code, wp.quantity, wp.reserved_quantity,
+			wp.quantity - wp.reserved_quantity, %s, wp.min_level, wp.reorder_point, %s
+		FROM warehouse_product wp
+		JOIN products p ON p.id = wp.product_id
+		WHERE wp.warehouse_id = $1 AND %s
+		ORDER BY %s - GREATEST(wp.min_level, wp.reorder_point), wp.product_id`,
+		reservableExpr("wp"), alertLevelExpr("wp"), lowStockCondition("wp"), reservableExpr("wp")), warehouseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get low stock: %w", err)
+	}
+	defer rows.Close()
+
+	items := make([]*models.LowStockItem, 0)
+	for rows.Next() {
+		var item models.LowStockItem
+		if err := rows.Scan(&item.WarehouseID, &item.ProductID, &item.Code, &item.Quantity, &item.ReservedQuantity,
+			&item.Available, &item.Reservable, &item.MinLevel, &item.ReorderPoint, &item.Level); err != nil {
+			return nil, fmt.Errorf("failed to scan low stock: %w", err)
+		}
+		items = append(items, &item)
+	}
+
+	return items, rows.Err()
+}
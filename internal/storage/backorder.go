@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+// insertBackordersTx queues the lines as pending backorders of the reservation
+func insertBackordersTx(ctx context.Context, tx *sql.Tx, reservationID int, lines []models.StockLine) error {
+	for _, line := range lines {
+		_, err := tx.ExecContext(ctx, "INSERT INTO backorders (reservation_id, warehouse_id, product_id, quantity) VALUES ($1, $2, $3, $4)",
+			reservationID, line.WarehouseID, line.ProductID, line.Quantity)
+		if err != nil {
+			return fmt.Errorf("failed to insert backorder: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// cancelBackordersTx cancels pending backorders of the reservation so that they are not filled any more.
+// Backorders are locked after the warehouse_product rows of their products, like fills lock them,
+// so the stock rows of the reservation are locked first in the order of lockOrder
+func cancelBackordersTx(ctx context.Context, tx *sql.Tx, reservationID int) error {
+	_, err := tx.ExecContext(ctx, `SELECT 1 FROM warehouse_product
+		WHERE (warehouse_id, product_id) IN (
+			SELECT warehouse_id, product_id FROM reservation_lines WHERE reservation_id = $1
+			UNION
+			SELECT warehouse_id, product_id FROM backorders WHERE reservation_id = $1 AND status = $2
+		)
+		ORDER BY warehouse_id, product_id
+		FOR UPDATE`, reservationID, models.BackorderPending)
+	if err != nil {
+		return fmt.Errorf("failed to lock reservation stock: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE backorders SET status = $1, updated_at = NOW() WHERE reservation_id = $2 AND status = $3",
+		models.BackorderCancelled, reservationID, models.BackorderPending)
+	if err != nil {
+		return fmt.Errorf("failed to cancel backorders: %w", err)
+	}
+
+	return nil
+}
+
+// fillBackordersTx reserves stock that became available for pending backorders of the lines' products.
+// The warehouse_product rows of the lines must already be locked by the transaction.
+func fillBackordersTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine) error {
+	var previous models.StockLine
+	for n, i := range lockOrder(lines) {
+		line := lines[i]
+		if n > 0 && line.WarehouseID == previous.WarehouseID && line.ProductID == previous.ProductID {
+			continue
+		}
+		previous = line
+
+		if err := fillProductBackordersTx(ctx, tx, line.WarehouseID, line.ProductID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fillWarehouseBackordersTx fills pending backorders of every product of the warehouse, e.g. after it is unblocked
+// or its safety stock is lowered. The warehouse row must already be locked by the transaction.
+func fillWarehouseBackordersTx(ctx context.Context, tx *sql.Tx, warehouseID int) error {
+	rows, err := tx.QueryContext(ctx, `SELECT wp.product_id FROM warehouse_product wp
+		WHERE wp.warehouse_id = $1 AND EXISTS (
+			SELECT 1 FROM backorders b WHERE b.warehouse_id = wp.warehouse_id AND b.product_id = wp.product_id AND b.status = $2
+		)
+		ORDER BY wp.product_id
+		FOR UPDATE OF wp`, warehouseID, models.BackorderPending)
+	if err != nil {
+		return fmt.Errorf("failed to lock backordered stock: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []models.StockLine
+	for rows.Next() {
+		line := models.StockLine{WarehouseID: warehouseID}
+		if err := rows.Scan(&line.ProductID); err != nil {
+			return fmt.Errorf("failed to scan backordered stock: %w", err)
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return fillBackordersTx(ctx, tx, lines)
+}
+
+// fillProductBackordersTx fills pending backorders of active reservations in FIFO order while the warehouse
+// has reservable stock. Every fill adds a reservation line and records a backorder.filled event.
+// Blocked warehouses fill nothing. The caller holds the lock of the warehouse_product row, so fills of the product
+// are serialized and waiting for backorders locked by a concurrent cancellation keeps the FIFO order.
+func fillProductBackordersTx(ctx context.Context, tx *sql.Tx, warehouseID, productID int) error {
+	var available int
+	err := tx.QueryRowContext(ctx, `SELECT `+reservableExpr("wp")+` FROM warehouse_product wp
+		JOIN warehouses w ON w.id = wp.warehouse_id
+		WHERE wp.warehouse_id = $1 AND wp.product_id = $2 AND w.availability`, warehouseID, productID).Scan(&available)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get available stock: %w", err)
+	}
+	if available <= 0 {
+		return nil
+	}
+
+	query, args, err := squirrel.Select("b.id", "b.reservation_id", "b.quantity - b.filled_quantity").
+		From("backorders b").
+		Join("reservations r ON r.id = b.reservation_id").
+		Where(squirrel.Eq{"b.warehouse_id": warehouseID, "b.product_id": productID,
+			"b.status": models.BackorderPending, "r.status": models.ReservationActive}).
+		OrderBy("b.id").
+		Suffix("FOR UPDATE OF b").
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to get backorders: %w", err)
+	}
+	defer rows.Close()
+
+	// Quantity of the scanned backorders is the quantity left to fill
+	var backorders []models.Backorder
+	for rows.Next() {
+		var backorder models.Backorder
+		if err := rows.Scan(&backorder.ID, &backorder.ReservationID, &backorder.Quantity); err != nil {
+			return fmt.Errorf("failed to scan backorders: %w", err)
+		}
+		backorders = append(backorders, backorder)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, backorder := range backorders {
+		if available == 0 {
+			break
+		}
+		filled := min(backorder.Quantity, available)
+		available -= filled
+
+		failed, err := reserveStockTx(ctx, tx, []models.StockLine{{WarehouseID: warehouseID, ProductID: productID, Quantity: filled}}, false)
+		if err != nil {
+			return err
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("cannot fill backorder %d: %s", backorder.ID, failed[0].Reason)
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO reservation_lines (reservation_id, warehouse_id, product_id, quantity) VALUES ($1, $2, $3, $4)",
+			backorder.ReservationID, warehouseID, productID, filled)
+		if err != nil {
+			return fmt.Errorf("failed to insert reservation line: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE backorders SET filled_quantity = filled_quantity + $1,
+			status = CASE WHEN filled_quantity + $1 = quantity THEN $2 ELSE status END, updated_at = NOW() WHERE id = $3`,
+			filled, models.BackorderFilled, backorder.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update backorder: %w", err)
+		}
+
+		err = recordEventTx(ctx, tx, models.EventBackorderFilled, models.BackorderFilledEvent{
+			BackorderID:   backorder.ID,
+			ReservationID: backorder.ReservationID,
+			WarehouseID:   warehouseID,
+			ProductID:     productID,
+			Quantity:      filled,
+			Remaining:     backorder.Quantity - filled,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBackordersTx returns backorders of the reservations grouped by reservation id
+func getBackordersTx(ctx context.Context, tx *sql.Tx, reservationIDs []int) (map[int][]models.Backorder, error) {
+	query, args, err := squirrel.Select("id", "reservation_id", "warehouse_id", "product_id", "quantity", "filled_quantity",
+		"status", "created_at", "updated_at").
+		From("backorders").
+		Where(squirrel.Eq{"reservation_id": reservationIDs}).
+		OrderBy("id").
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backorders: %w", err)
+	}
+	defer rows.Close()
+
+	backorders := make(map[int][]models.Backorder)
+	for rows.Next() {
+		var b models.Backorder
+		if err := rows.Scan(&b.ID, &b.ReservationID, &b.WarehouseID, &b.ProductID, &b.Quantity, &b.FilledQuantity,
+			&b.Status, &b.CreatedAt, &b.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan backorders: %w", err)
+		}
+		backorders[b.ReservationID] = append(backorders[b.ReservationID], b)
+	}
+
+	return backorders, rows.Err()
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+type BarcodeRepo struct {
+	db *sql.DB
+}
+
+func NewBarcodeRepo(db *sql.DB) *BarcodeRepo {
+	return &BarcodeRepo{
+		db: db,
+	}
+}
+
+// AddBarcodes assigns the barcodes to the product, a barcode of another product is a conflict.
+// Barcodes the product already has are kept
+func (r *BarcodeRepo) AddBarcodes(ctx context.Context, productID int, barcodes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	for _, barcode := range barcodes {
+		var owner int
+		err = tx.QueryRowContext(ctx, `INSERT INTO product_barcodes (barcode, product_id) VALUES ($1, $2)
+			ON CONFLICT (barcode) DO UPDATE SET barcode = EXCLUDED.barcode
+			RETURNING product_id`, barcode, productID).Scan(&owner)
+		if isForeignKeyViolation(err) {
+			err = fmt.Errorf("no product with ID: %d: %w", productID, ErrNotFound)
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to insert barcode: %w", err)
+		}
+		if owner != productID {
+			err = fmt.Errorf("barcode %s belongs to product %d: %w", barcode, owner, ErrConflict)
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *BarcodeRepo) GetBarcodes(ctx context.Context, filter models.GetBarcodesFilter) ([]*models.ProductBarcode, error) {
+	queryBuilder := squirrel.Select("barcode", "product_id", "created_at").From("product_barcodes").
+		OrderBy("product_id", "created_at", "barcode").PlaceholderFormat(squirrel.Dollar)
+	if len(filter.Barcodes) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"barcode": filter.Barcodes})
+	}
+	if len(filter.ProductIDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"product_id": filter.ProductIDs})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get barcodes: %w", err)
+	}
+	defer rows.Close()
+
+	barcodes := make([]*models.ProductBarcode, 0)
+	for rows.Next() {
+		var barcode models.ProductBarcode
+		if err := rows.Scan(&barcode.Barcode, &barcode.ProductID, &barcode.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan barcodes: %w", err)
+		}
+		barcodes = append(barcodes, &barcode)
+	}
+
+	return barcodes, rows.Err()
+}
+
+func (r *BarcodeRepo) DeleteBarcode(ctx context.Context, barcode string) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM product_barcodes WHERE barcode = $1", barcode)
+	if err != nil {
+		return fmt.Errorf("failed to delete barcode: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete barcode: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("no barcode %s: %w", barcode, ErrNotFound)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"errors"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrNotFound is returned when a requested entity doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrInsufficientStock is returned when there is not enough stock or reserve for a change
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrConflict is returned when a change conflicts with the current state of an entity
+	ErrConflict = errors.New("conflict")
+	// ErrWarehouseUnavailable is returned when a change touches a blocked warehouse
+	ErrWarehouseUnavailable = errors.New("warehouse unavailable")
+	// ErrInvalidFilter is returned for unknown sort fields, malformed cursors and other invalid list parameters
+	ErrInvalidFilter = errors.New("invalid filter")
+	// ErrInvalidQuantity is returned for quantities given in packs that aren't a whole number of base units
+	ErrInvalidQuantity = errors.New("invalid quantity")
+)
+
+// StockLinesError reports stock lines that failed. Reason is the failure reason that decides the error,
+// Failed holds the failed lines in the form they are returned to the client
+type StockLinesError struct {
+	Message string
+	Reason  string
+	Failed  interface{}
+}
+
+func (e *StockLinesError) Error() string {
+	return e.Message
+}
+
+// Unwrap maps Reason to the matching sentinel error
+func (e *StockLinesError) Unwrap() error {
+	switch e.Reason {
+	case models.ReasonNotFound:
+		return ErrNotFound
+	case models.ReasonWarehouseUnavailable:
+		return ErrWarehouseUnavailable
+	case models.ReasonFractionalQuantity, models.ReasonInvalidQuantity:
+		return ErrInvalidQuantity
+	}
+	return ErrInsufficientStock
+}
+
+// PostgreSQL codes of constraint violations
+const (
+	uniqueViolationCode     = "23505"
+	foreignKeyViolationCode = "23503"
+)
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolationCode
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolationCode
+}
+
+// violatedConstraint returns the name of the constraint violated by err, empty for other errors
+func violatedConstraint(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Constraint
+	}
+	return ""
+}
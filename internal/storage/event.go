@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+const defaultEventsLimit = 100
+
+// eventsLockKey is the key of the transaction-level advisory lock that serializes event inserts
+const eventsLockKey = 7501
+
+type EventRepo struct {
+	db *sql.DB
+}
+
+func NewEventRepo(db *sql.DB) *EventRepo {
+	return &EventRepo{
+		db: db,
+	}
+}
+
+// GetEvents returns events with ids greater than filter.AfterID in id order,
+// so consumers can poll the outbox from the last id they have seen.
+// Events become visible in id order, see recordEventTx, so an event never appears behind a seen id
+func (r *EventRepo) GetEvents(ctx context.Context, filter models.GetEventsFilter) ([]*models.Event, error) {
+	var events []*models.Event
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultEventsLimit
+	}
+
+	queryBuilder := squirrel.Select("id", "type", "payload", "created_at").
+		From("events").
+		Where(squirrel.Gt{"id": filter.AfterID}).
+		OrderBy("id").
+		Limit(uint64(limit)).
+		PlaceholderFormat(squirrel.Dollar)
+	if len(filter.Types) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"type": filter.Types})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event models.Event
+		if err := rows.Scan(&event.ID, &event.Type, &event.Payload, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan events: %w", err)
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// recordEventTx adds an event to the outbox in the transaction of the change it notifies about.
+// Ids are taken from the sequence before commit, so inserts are serialized by an advisory lock held until commit:
+// otherwise an event with a lower id could commit after a consumer has already read a higher one and be lost
+func recordEventTx(ctx context.Context, tx *sql.Tx, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event payload: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", eventsLockKey)
+	if err != nil {
+		return fmt.Errorf("failed to lock events: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO events (type, payload) VALUES ($1, $2)", eventType, data)
+	if err != nil {
+		return fmt.Errorf("failed to insert event: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+	"time"
+)
+
+type IdempotencyRepo struct {
+	db *sql.DB
+}
+
+func NewIdempotencyRepo(db *sql.DB) *IdempotencyRepo {
+	return &IdempotencyRepo{
+		db: db,
+	}
+}
+
+// CreateIdempotencyKey stores a new key and reports false if the key is already taken.
+// Keys older than ttl and keys of requests in progress for longer than inProgressTimeout,
+// abandoned by a crash, are taken over as new ones with the owner of the key
+func (r *IdempotencyRepo) CreateIdempotencyKey(ctx context.Context, key models.IdempotencyKey, inProgressTimeout time.Duration, ttl time.Duration) (bool, error) {
+	insertQuery := squirrel.Insert("idempotency_keys").
+		Columns("key", "owner", "request_hash").
+		Values(key.Key, key.Owner, key.RequestHash).
+		Suffix(`ON CONFLICT (key) DO UPDATE SET owner = EXCLUDED.owner, request_hash = EXCLUDED.request_hash, status_code = 0, response = NULL,
+			created_at = NOW()
+			WHERE (idempotency_keys.status_code = 0 AND idempotency_keys.created_at < NOW() - make_interval(secs => ?))
+				OR idempotency_keys.created_at < NOW() - make_interval(secs => ?)`,
+			inProgressTimeout.Seconds(), ttl.Seconds()).
+		PlaceholderFormat(squirrel.Dollar)
+
+	query, args, err := insertQuery.ToSql()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert idempotency key: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (r *IdempotencyRepo) GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyKey, error) {
+	query, args, err := squirrel.Select("key", "owner", "request_hash", "status_code", "response", "created_at").
+		From("idempotency_keys").
+		Where(squirrel.Eq{"key": key}).
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var k models.IdempotencyKey
+	err = r.db.QueryRowContext(ctx, query, args...).Scan(&k.Key, &k.Owner, &k.RequestHash, &k.StatusCode, &k.Response, &k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+
+	return &k, nil
+}
+
+// UpdateIdempotencyKey stores the response of the owner of the key. ErrConflict means the key
+// was taken over by another request in the meantime and the response isn't stored
+func (r *IdempotencyRepo) UpdateIdempotencyKey(ctx context.Context, input *models.UpdateIdempotencyKeyInput) error {
+	query, args, err := squirrel.Update("idempotency_keys").
+		Set("status_code", input.StatusCode).
+		Set("response", input.Response).
+		Where(squirrel.Eq{"key": input.Key, "owner": input.Owner}).
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return err
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update idempotency key: %w", err)
+	}
+
+	return checkIdempotencyKeyOwned(result, input.Key)
+}
+
+// DeleteIdempotencyKey deletes the key if it is still held by owner, see UpdateIdempotencyKey
+func (r *IdempotencyRepo) DeleteIdempotencyKey(ctx context.Context, key string, owner string) error {
+	query, args, err := squirrel.Delete("idempotency_keys").
+		Where(squirrel.Eq{"key": key, "owner": owner}).
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return err
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to delete idempotency key: %w", err)
+	}
+
+	return checkIdempotencyKeyOwned(result, key)
+}
+
+func checkIdempotencyKeyOwned(result sql.Result, key string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("idempotency key %s is held by another request: %w", key, ErrConflict)
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes keys older than ttl and returns how many were deleted
+func (r *IdempotencyRepo) DeleteExpiredIdempotencyKeys(ctx context.Context, ttl time.Duration) (int, error) {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < NOW() - make_interval(secs => $1)", ttl.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(deleted), nil
+}
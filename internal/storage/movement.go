@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+	"time"
+)
+
+const snapshotBatchSize = 1000
+
+type movementSourceKey struct{}
+
+type movementSource struct {
+	actor     string
+	requestID string
+}
+
+// WithMovementSource returns a context whose stock movements are recorded with the given actor and request ID
+func WithMovementSource(ctx context.Context, actor, requestID string) context.Context {
+	return context.WithValue(ctx, movementSourceKey{}, movementSource{actor: actor, requestID: requestID})
+}
+
+type MovementRepo struct {
+	db *sql.DB
+}
+
+func NewMovementRepo(db *sql.DB) *MovementRepo {
+	return &MovementRepo{
+		db: db,
+	}
+}
+
+var movementSortColumns = sortColumns{"id": "m.id", "created_at": "m.created_at"}
+
+// GetStockMovements returns a page of stock movements matching the filter and the cursor of the next page
+func (r *MovementRepo) GetStockMovements(ctx context.Context, filter models.GetStockMovementsFilter) ([]*models.StockMovement, string, error) {
+	var movements []*models.StockMovement
+	var keys []string
+	var ids []int
+
+	queryBuilder := squirrel.Select("m.id", "m.warehouse_id", "m.product_id", "m.type", "m.quantity_delta", "m.reserved_delta",
+		"m.in_transit_delta", "m.reason", "m.actor", "m.request_id", "m.created_at").
+		From("stock_movements m").
+		PlaceholderFormat(squirrel.Dollar)
+	if filter.WarehouseID != 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"m.warehouse_id": filter.WarehouseID})
+	}
+	if filter.ProductID != 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"m.product_id": filter.ProductID})
+	}
+	if filter.ProductCode != "" {
+		queryBuilder = queryBuilder.Join("products p ON p.id = m.product_id").Where(squirrel.Eq{"p.code": filter.ProductCode})
+	}
+	if len(filter.Types) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"m.type": filter.Types})
+	}
+	if filter.From != nil {
+		queryBuilder = queryBuilder.Where(squirrel.GtOrEq{"m.created_at": *filter.From})
+	}
+	if filter.To != nil {
+		queryBuilder = queryBuilder.Where(squirrel.Lt{"m.created_at": *filter.To})
+	}
+	queryBuilder, err := paginate(queryBuilder, filter.Page, movementSortColumns, "m.id")
+	if err != nil {
+		return nil, "", err
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get stock movements: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m models.StockMovement
+		var key string
+		if err := rows.Scan(&m.ID, &m.WarehouseID, &m.ProductID, &m.Type, &m.QuantityDelta, &m.ReservedDelta,
+			&m.InTransitDelta, &m.Reason, &m.Actor, &m.RequestID, &m.CreatedAt, &key); err != nil {
+			return nil, "", fmt.Errorf("failed to scan stock movements: %w", err)
+		}
+		movements = append(movements, &m)
+		keys = append(keys, key)
+		ids = append(ids, int(m.ID))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	count, next := cutPage(filter.Page, keys, ids)
+
+	return movements[:count], next, nil
+}
+
+// CreateStockSnapshot materialises the stock as of the last midnight that is at least delay ago,
+// unless that snapshot already exists. It returns the time of the snapshot and the number of stored rows.
+func (r *MovementRepo) CreateStockSnapshot(ctx context.Context, delay time.Duration) (time.Time, int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	var at time.Time
+	err = tx.QueryRowContext(ctx, "SELECT date_trunc('day', NOW() - make_interval(secs => $1))::timestamp", delay.Seconds()).Scan(&at)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to get snapshot time: %w", err)
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM stock_snapshots WHERE snapshot_at = $1)", at).Scan(&exists)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to check stock snapshot: %w", err)
+	}
+	if exists {
+		err = tx.Commit()
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return at, 0, nil
+	}
+
+	stock, err := getStockAsOfTx(ctx, tx, models.GetWarehouseProductFilter{}, at)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	for start := 0; start < len(stock); start += snapshotBatchSize {
+		insertQuery := squirrel.Insert("stock_snapshots").
+			Columns("snapshot_at", "warehouse_id", "product_id", "quantity", "reserved_quantity", "in_transit_quantity").
+			Suffix("ON CONFLICT DO NOTHING").
+			PlaceholderFormat(squirrel.Dollar)
+		for _, wp := range stock[start:min(start+snapshotBatchSize, len(stock))] {
+			insertQuery = insertQuery.Values(at, wp.WarehouseID, wp.ProductID, wp.Quantity, wp.ReservedQuantity, wp.InTransitQuantity)
+		}
+
+		var query string
+		var args []interface{}
+		query, args, err = insertQuery.ToSql()
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("failed to insert stock snapshot: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return at, len(stock), nil
+}
+
+// getStockAsOfTx reconstructs warehouse_product quantities as of the given time. It starts from the latest
+// daily snapshot taken at or before that time and adds the later movements; without such a snapshot it
+// subtracts the movements made after that time from the current stock. Rows without stock are omitted,
+// rows deleted since then have zero ID. Reservable uses the current safety stock settings.
+func getStockAsOfTx(ctx context.Context, tx *sql.Tx, filter models.GetWarehouseProductFilter, at time.Time) ([]*models.WarehouseProduct, error) {
+	var snapshotAt sql.NullTime
+	err := tx.QueryRowContext(ctx, "SELECT MAX(snapshot_at) FROM stock_snapshots WHERE snapshot_at <= $1", at).Scan(&snapshotAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stock snapshot: %w", err)
+	}
+
+	var base, movements squirrel.SelectBuilder
+	if snapshotAt.Valid {
+		base = squirrel.Select("warehouse_id", "product_id", "quantity", "reserved_quantity", "in_transit_quantity").
+			From("stock_snapshots").
+			Where(squirrel.Eq{"snapshot_at": snapshotAt.Time})
+		movements = squirrel.Select("warehouse_id", "product_id", "quantity_delta", "reserved_delta", "in_transit_delta").
+			From("stock_movements").
+			Where(squirrel.Gt{"created_at": snapshotAt.Time}).
+			Where(squirrel.LtOrEq{"created_at": at})
+	} else {
+		base = squirrel.Select("warehouse_id", "product_id", "quantity", "reserved_quantity", "in_transit_quantity").
+			From("warehouse_product")
+		movements = squirrel.Select("warehouse_id", "product_id", "-quantity_delta", "-reserved_delta", "-in_transit_delta").
+			From("stock_movements").
+			Where(squirrel.Gt{"created_at": at})
+	}
+	if filter.WarehouseID != 0 {
+		base = base.Where(squirrel.Eq{"warehouse_id": filter.WarehouseID})
+		movements = movements.Where(squirrel.Eq{"warehouse_id": filter.WarehouseID})
+	}
+	if filter.ProductID != 0 {
+		base = base.Where(squirrel.Eq{"product_id": filter.ProductID})
+		movements = movements.Where(squirrel.Eq{"product_id": filter.ProductID})
+	}
+
+	baseQuery, baseArgs, err := base.ToSql()
+	if err != nil {
+		return nil, err
+	}
+	movementsQuery, movementsArgs, err := movements.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := squirrel.Dollar.ReplacePlaceholders(fmt.Sprintf(`SELECT COALESCE(wp.id, 0), s.warehouse_id, s.product_id,
+		s.quantity, s.reserved_quantity, s.in_transit_quantity, wp.safety_stock,
+		s.quantity - s.reserved_quantity - COALESCE(wp.safety_stock, w.safety_stock, 0)
+		FROM (
+			SELECT warehouse_id, product_id, SUM(quantity) AS quantity, SUM(reserved_quantity) AS reserved_quantity,
+				SUM(in_transit_quantity) AS in_transit_quantity
+			FROM (%s UNION ALL %s) u
+			GROUP BY warehouse_id, product_id
+		) s
+		LEFT JOIN warehouse_product wp ON wp.warehouse_id = s.warehouse_id AND wp.product_id = s.product_id
+		LEFT JOIN warehouses w ON w.id = s.warehouse_id
+		WHERE s.quantity <> 0 OR s.reserved_quantity <> 0 OR s.in_transit_quantity <> 0
+		ORDER BY s.warehouse_id, s.product_id`, baseQuery, movementsQuery))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, append(baseArgs, movementsArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stock as of %s: %w", at, err)
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool, len(filter.IDs))
+	for _, id := range filter.IDs {
+		ids[id] = true
+	}
+
+	var stock []*models.WarehouseProduct
+	for rows.Next() {
+		var wp models.WarehouseProduct
+		if err := rows.Scan(&wp.ID, &wp.WarehouseID, &wp.ProductID, &wp.Quantity, &wp.ReservedQuantity, &wp.InTransitQuantity,
+			&wp.SafetyStock, &wp.Reservable); err != nil {
+			return nil, fmt.Errorf("failed to scan warehouse products: %w", err)
+		}
+		if len(ids) > 0 && !ids[wp.ID] {
+			continue
+		}
+		stock = append(stock, &wp)
+	}
+
+	return stock, rows.Err()
+}
+
+// recordStockMovementTx appends the movement to the ledger in the transaction of the stock change.
+// Movements that change nothing are skipped.
+func recordStockMovementTx(ctx context.Context, tx *sql.Tx, movement models.StockMovement) error {
+	if movement.QuantityDelta == 0 && movement.ReservedDelta == 0 && movement.InTransitDelta == 0 {
+		return nil
+	}
+
+	source, _ := ctx.Value(movementSourceKey{}).(movementSource)
+
+	insertQuery := squirrel.Insert("stock_movements").
+		Columns("warehouse_id", "product_id", "type", "quantity_delta", "reserved_delta", "in_transit_delta", "reason",
+			"actor", "request_id").
+		Values(movement.WarehouseID, movement.ProductID, movement.Type, movement.QuantityDelta, movement.ReservedDelta,
+			movement.InTransitDelta, movement.Reason, source.actor, source.requestID).
+		PlaceholderFormat(squirrel.Dollar)
+
+	query, args, err := insertQuery.ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to record stock movement: %w", err)
+	}
+
+	return nil
+}
+
+// adjustMovements records a direct change of a warehouse_product row from old to new.
+// A row moved to another warehouse or product is recorded as removed from the old one and added to the new one.
+func adjustMovements(old, new models.WarehouseProduct) []models.StockMovement {
+	if old.WarehouseID == new.WarehouseID && old.ProductID == new.ProductID {
+		return []models.StockMovement{{
+			WarehouseID:    new.WarehouseID,
+			ProductID:      new.ProductID,
+			Type:           models.MovementAdjust,
+			QuantityDelta:  new.Quantity - old.Quantity,
+			ReservedDelta:  new.ReservedQuantity - old.ReservedQuantity,
+			InTransitDelta: new.InTransitQuantity - old.InTransitQuantity,
+		}}
+	}
+
+	return append(adjustMovements(old, models.WarehouseProduct{WarehouseID: old.WarehouseID, ProductID: old.ProductID}),
+		adjustMovements(models.WarehouseProduct{WarehouseID: new.WarehouseID, ProductID: new.ProductID}, new)...)
+}
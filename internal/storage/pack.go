@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"LamodaTest/internal/units"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+type PackRepo struct {
+	db *sql.DB
+}
+
+func NewPackRepo(db *sql.DB) *PackRepo {
+	return &PackRepo{
+		db: db,
+	}
+}
+
+// SetPack creates the pack of the product or changes its quantity. Stock is kept in base units,
+// so changing a pack doesn't change the stock. A pack can't be named like the base unit of the product
+func (r *PackRepo) SetPack(ctx context.Context, pack models.ProductPack) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	var unit string
+	err = tx.QueryRowContext(ctx, "SELECT unit FROM products WHERE id = $1 FOR SHARE", pack.ProductID).Scan(&unit)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("no product with ID: %d: %w", pack.ProductID, ErrNotFound)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get product: %w", err)
+	}
+	if pack.Name == unit {
+		err = fmt.Errorf("%s is the base unit of product %d: %w", unit, pack.ProductID, ErrConflict)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO product_packs (product_id, name, quantity) VALUES ($1, $2, $3)
+		ON CONFLICT (product_id, name) DO UPDATE SET quantity = EXCLUDED.quantity`, pack.ProductID, pack.Name, pack.Quantity)
+	if err != nil {
+		return fmt.Errorf("failed to set pack: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *PackRepo) GetPacks(ctx context.Context, productID int) ([]*models.ProductPack, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT product_id, name, quantity FROM product_packs
+		WHERE product_id = $1 ORDER BY quantity, name`, productID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packs: %w", err)
+	}
+	defer rows.Close()
+
+	packs := make([]*models.ProductPack, 0)
+	for rows.Next() {
+		var pack models.ProductPack
+		if err := rows.Scan(&pack.ProductID, &pack.Name, &pack.Quantity); err != nil {
+			return nil, fmt.Errorf("failed to scan packs: %w", err)
+		}
+		packs = append(packs, &pack)
+	}
+
+	return packs, rows.Err()
+}
+
+func (r *PackRepo) DeletePack(ctx context.Context, productID int, name string) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM product_packs WHERE product_id = $1 AND name = $2", productID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete pack: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete pack: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("product %d has no pack %s: %w", productID, name, ErrNotFound)
+	}
+
+	return nil
+}
+
+// ConvertPacks resolves the products of lines given in packs and sets their Quantity in base units.
+// The base unit of the product can be used as a pack of one. Lines with unknown products or packs
+// and lines that aren't a positive whole number of base units are returned as failed
+func (r *PackRepo) ConvertPacks(ctx context.Context, lines []models.StockLine) ([]models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	// Only lines in packs are resolved, the operation itself reports unknown products of the other lines
+	packLines := make([]models.StockLine, 0, len(lines))
+	origins := make([]int, 0, len(lines))
+	for i, line := range lines {
+		if line.Pack != "" {
+			packLines = append(packLines, line)
+			origins = append(origins, i)
+		}
+	}
+	resolveFailed, err := resolveStockLinesTx(ctx, tx, packLines)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []models.FailedStockLine
+	for _, line := range resolveFailed {
+		line.Line = origins[line.Line]
+		failed = append(failed, line)
+	}
+	productIDs := make([]int, 0, len(packLines))
+	for i, line := range packLines {
+		lines[origins[i]].ProductID, lines[origins[i]].Code = line.ProductID, line.Code
+		if line.ProductID != 0 {
+			productIDs = append(productIDs, line.ProductID)
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, unit, 1 FROM products WHERE id = ANY($1)
+		UNION ALL
+		SELECT product_id, name, quantity FROM product_packs WHERE product_id = ANY($1)`, pq.Array(productIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packs: %w", err)
+	}
+	defer rows.Close()
+
+	type packKey struct {
+		productID int
+		name      string
+	}
+	sizes := make(map[packKey]int)
+	for rows.Next() {
+		var key packKey
+		var size int
+		if err := rows.Scan(&key.productID, &key.name, &size); err != nil {
+			return nil, fmt.Errorf("failed to scan packs: %w", err)
+		}
+		sizes[key] = size
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range lines {
+		if lines[i].Pack == "" || lines[i].ProductID == 0 {
+			continue
+		}
+		size, ok := sizes[packKey{productID: lines[i].ProductID, name: lines[i].Pack}]
+		if !ok {
+			failed = append(failed, models.FailedStockLine{StockLine: lines[i], Line: i, Reason: models.ReasonNotFound})
+			continue
+		}
+
+		quantity, err := units.ToBase(lines[i].Packs, size)
+		switch {
+		case errors.Is(err, units.ErrFractionalQuantity):
+			failed = append(failed, models.FailedStockLine{StockLine: lines[i], Line: i, Reason: models.ReasonFractionalQuantity})
+		case err != nil || quantity <= 0:
+			failed = append(failed, models.FailedStockLine{StockLine: lines[i], Line: i, Reason: models.ReasonInvalidQuantity})
+		default:
+			lines[i].Quantity = quantity
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return failed, nil
+}
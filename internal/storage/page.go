@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+	"strings"
+)
+
+// sortColumns maps the sort fields of a list to their SQL expressions
+type sortColumns map[string]string
+
+// pageCursor is the position of the last row of a page: its sort key and id
+type pageCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int    `json:"i"`
+}
+
+// paginate orders the query by the sort field of the page and idColumn, skips rows up to the cursor and fetches
+// one row more than the page to find out if there is a next page. The sort key of every row is added as the last
+// column, rows are cut and the next cursor is made by cutPage
+func paginate(query squirrel.SelectBuilder, page models.PageFilter, columns sortColumns, idColumn string) (squirrel.SelectBuilder, error) {
+	if page.Limit < 0 {
+		return query, fmt.Errorf("negative limit %d: %w", page.Limit, ErrInvalidFilter)
+	}
+
+	sort := page.Sort
+	if sort == "" {
+		sort = "id"
+	}
+	field, descending := strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+	column, ok := columns[field]
+	if !ok {
+		return query, fmt.Errorf("unknown sort field %s: %w", field, ErrInvalidFilter)
+	}
+
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+	query = query.Column(fmt.Sprintf("CAST(%s AS TEXT)", column)).
+		OrderBy(fmt.Sprintf("%s %s", column, direction), fmt.Sprintf("%s %s", idColumn, direction))
+
+	if page.Cursor != "" {
+		cursor, err := decodeCursor(page.Cursor)
+		if err != nil || cursor.Sort != sort {
+			return query, fmt.Errorf("cursor doesn't match sort %s: %w", sort, ErrInvalidFilter)
+		}
+		query = query.Where(fmt.Sprintf("(%s, %s) %s (?, ?)", column, idColumn, comparison), cursor.Key, cursor.ID)
+	}
+	if page.Limit > 0 {
+		query = query.Limit(uint64(page.Limit) + 1)
+	}
+
+	return query, nil
+}
+
+// cutPage returns the number of rows of the page and the cursor of the next page, empty on the last page.
+// keys and ids are the sort keys and ids of the rows fetched by paginate
+func cutPage(page models.PageFilter, keys []string, ids []int) (int, string) {
+	if page.Limit == 0 || len(keys) <= page.Limit {
+		return len(keys), ""
+	}
+
+	sort := page.Sort
+	if sort == "" {
+		sort = "id"
+	}
+	last := page.Limit - 1
+	data, _ := json.Marshal(pageCursor{Sort: sort, Key: keys[last], ID: ids[last]})
+
+	return page.Limit, base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (pageCursor, error) {
+	var cursor pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, err
+	}
+
+	return cursor, json.Unmarshal(data, &cursor)
+}
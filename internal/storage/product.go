@@ -4,8 +4,10 @@ import (
 	"LamodaTest/internal/models"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/Masterminds/squirrel"
+	"strings"
 )
 
 type ProductRepo struct {
@@ -21,7 +23,7 @@ func NewProductRepo(db *sql.DB) *ProductRepo {
 func (r *ProductRepo) CreateProduct(ctx context.Context, p models.Product) (int, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -34,8 +36,8 @@ func (r *ProductRepo) CreateProduct(ctx context.Context, p models.Product) (int,
 	}()
 
 	insertQuery := squirrel.Insert("products").
-		Columns("name", "size", "code").
-		Values(p.Name, p.Size, p.Code).
+		Columns("name", "size", "code", "style_id", "color", "unit").
+		Values(p.Name, p.Size, p.Code, p.StyleID, p.Color, p.Unit).
 		Suffix("RETURNING id").
 		RunWith(tx).PlaceholderFormat(squirrel.Dollar)
 
@@ -46,24 +48,49 @@ func (r *ProductRepo) CreateProduct(ctx context.Context, p models.Product) (int,
 
 	var id int
 	err = tx.QueryRowContext(ctx, sql, args...).Scan(&id)
+	if constraintErr := productConstraintError(err); constraintErr != nil {
+		return 0, constraintErr
+	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert product: %v", err)
+		return 0, fmt.Errorf("failed to insert product: %w", err)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return id, nil
 }
 
-func (r *ProductRepo) GetProducts(ctx context.Context, filter models.GetProductsFilter) ([]*models.Product, error) {
+// productVariantIndex is the unique index of sizes and colors of style variants
+const productVariantIndex = "products_style_variant_idx"
+
+// productConstraintError maps violations of the constraints of products to storage errors, nil for other errors
+func productConstraintError(err error) error {
+	switch {
+	case isUniqueViolation(err) && violatedConstraint(err) == productVariantIndex:
+		return fmt.Errorf("style already has a variant of this size and color: %w", ErrConflict)
+	case isUniqueViolation(err):
+		return fmt.Errorf("product with this code already exists: %w", ErrConflict)
+	case isForeignKeyViolation(err):
+		return fmt.Errorf("no such style: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// productSortColumns are the sort fields of GetProducts
+var productSortColumns = sortColumns{"id": "id", "name": "name", "size": "size", "code": "code"}
+
+// GetProducts returns a page of products matching the filter and the cursor of the next page
+func (r *ProductRepo) GetProducts(ctx context.Context, filter models.GetProductsFilter) ([]*models.Product, string, error) {
 	var products []*models.Product
+	var keys []string
+	var ids []int
 
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+		return nil, "", fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -75,44 +102,124 @@ func (r *ProductRepo) GetProducts(ctx context.Context, filter models.GetProducts
 		}
 	}()
 
-	queryBuilder := squirrel.Select("id", "name", "size", "code").From("products").RunWith(tx).PlaceholderFormat(squirrel.Dollar)
+	queryBuilder := squirrel.Select("id", "name", "size", "code", "style_id", "color", "unit").From("products").RunWith(tx).PlaceholderFormat(squirrel.Dollar)
 	if len(filter.IDs) > 0 {
 		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
 	}
 	if len(filter.Codes) > 0 {
 		queryBuilder = queryBuilder.Where(squirrel.Eq{"code": filter.Codes})
 	}
+	if filter.Name != "" {
+		queryBuilder = queryBuilder.Where(squirrel.ILike{"name": "%" + filter.Name + "%"})
+	}
+	if filter.Size != "" {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"size": filter.Size})
+	}
+	if filter.Color != "" {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"color": filter.Color})
+	}
+	if len(filter.StyleIDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"style_id": filter.StyleIDs})
+	}
+	queryBuilder, err = paginate(queryBuilder, filter.Page, productSortColumns, "id")
+	if err != nil {
+		return nil, "", err
+	}
 	query, args, err := queryBuilder.ToSql()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var product models.Product
-		if err := rows.Scan(&product.ID, &product.Name, &product.Size, &product.Code); err != nil {
-			return nil, fmt.Errorf("failed to scan products: %v", err)
+		var key string
+		if err := rows.Scan(&product.ID, &product.Name, &product.Size, &product.Code, &product.StyleID, &product.Color, &product.Unit,
+			&key); err != nil {
+			return nil, "", fmt.Errorf("failed to scan products: %w", err)
 		}
 		products = append(products, &product)
+		keys = append(keys, key)
+		ids = append(ids, product.ID)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return products, nil
+	count, next := cutPage(filter.Page, keys, ids)
+
+	return products[:count], next, nil
+}
+
+// productSearchRank ranks a product for the search query $1: a code starting with the query ranks highest,
+// then the best of trigram similarity of the code, word similarity of the name and full-text rank of the name
+const productSearchRank = `GREATEST(
+		CASE WHEN code ILIKE $2 THEN 1 ELSE 0 END,
+		similarity(code, $1),
+		word_similarity($1, name),
+		ts_rank(to_tsvector('simple', name), plainto_tsquery('simple', $1))
+	)`
+
+// productSearchCondition matches products for the search query $1 and the code prefix pattern $2
+// using the trigram and full-text indexes of products
+const productSearchCondition = `(code ILIKE $2 OR code % $1 OR $1 <% name
+		OR to_tsvector('simple', name) @@ plainto_tsquery('simple', $1))`
+
+// SearchProducts returns products matching the query by code prefix, similar code or name, best matches first
+func (r *ProductRepo) SearchProducts(ctx context.Context, filter models.SearchProductsFilter) ([]*models.ProductSearchResult, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	query := fmt.Sprintf(`SELECT id, name, size, code, style_id, color, unit, %s AS rank
+		FROM products
+		WHERE %s`, productSearchRank, productSearchCondition)
+	args := []interface{}{filter.Query, likePrefix(filter.Query), limit}
+	if filter.InStockWarehouseID != 0 {
+		query += ` AND EXISTS (
+			SELECT 1 FROM warehouse_product
+			WHERE product_id = products.id AND warehouse_id = $4 AND ` + reservableExpr("warehouse_product") + ` > 0
+		)`
+		args = append(args, filter.InStockWarehouseID)
+	}
+	query += " ORDER BY rank DESC, id LIMIT $3"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search products: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]*models.ProductSearchResult, 0)
+	for rows.Next() {
+		var result models.ProductSearchResult
+		if err := rows.Scan(&result.ID, &result.Name, &result.Size, &result.Code, &result.StyleID, &result.Color, &result.Unit,
+			&result.Rank); err != nil {
+			return nil, fmt.Errorf("failed to scan products: %w", err)
+		}
+		results = append(results, &result)
+	}
+
+	return results, rows.Err()
+}
+
+// likePrefix is the LIKE pattern of strings starting with prefix, wildcards of prefix are escaped
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
 }
 
 func (r *ProductRepo) UpdateProduct(ctx context.Context, input *models.UpdateProductInput) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -134,28 +241,65 @@ func (r *ProductRepo) UpdateProduct(ctx context.Context, input *models.UpdatePro
 	if input.Code != nil {
 		updateBuilder = updateBuilder.Set("code", *input.Code)
 	}
+	if input.StyleID != nil {
+		updateBuilder = updateBuilder.Set("style_id", *input.StyleID)
+	} else if input.ResetStyle {
+		updateBuilder = updateBuilder.Set("style_id", nil)
+	}
+	if input.Color != nil {
+		updateBuilder = updateBuilder.Set("color", *input.Color)
+	}
+	if input.Unit != nil {
+		// Stock is counted in the base unit, changing it would change the meaning of the stock
+		var stocked bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS (
+				SELECT 1 FROM warehouse_product WHERE product_id = $1 AND (quantity > 0 OR reserved_quantity > 0)
+			)`, input.ID).Scan(&stocked)
+		if err != nil {
+			return fmt.Errorf("failed to check product stock: %w", err)
+		}
+		if stocked {
+			err = fmt.Errorf("product %d has stock, its unit can't be changed: %w", input.ID, ErrConflict)
+			return err
+		}
+		updateBuilder = updateBuilder.Set("unit", *input.Unit)
+	}
 	query, args, err := updateBuilder.ToSql()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
+	if constraintErr := productConstraintError(err); constraintErr != nil {
+		return constraintErr
+	}
 	if err != nil {
-		return fmt.Errorf("cannot update product: %v", err)
+		return fmt.Errorf("cannot update product: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot update product: %w", err)
+	}
+	if updated == 0 {
+		err = fmt.Errorf("no product with ID: %d: %w", input.ID, ErrNotFound)
+		return err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
 
+// DeleteProduct deletes the product with everything that references it.
+// A product that still has stock, reserves or goods in transit in any warehouse,
+// pending backorders or open transfers and reservations can't be deleted
 func (r *ProductRepo) DeleteProduct(ctx context.Context, input models.DeleteProductInput) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -167,20 +311,73 @@ func (r *ProductRepo) DeleteProduct(ctx context.Context, input models.DeleteProd
 		}
 	}()
 
+	// The product row and its stock rows stay locked until the delete, so nothing can be
+	// reserved, received or transferred between the check and the delete
+	var locked int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM products WHERE id = $1 FOR UPDATE", input.ID).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("no product with ID: %d: %w", input.ID, ErrNotFound)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock product: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "SELECT 1 FROM warehouse_product WHERE product_id = $1 ORDER BY warehouse_id FOR UPDATE", input.ID)
+	if err != nil {
+		return fmt.Errorf("failed to lock product stock: %w", err)
+	}
+
+	var stocked, pending bool
+	err = tx.QueryRowContext(ctx, `SELECT
+			EXISTS (
+				SELECT 1 FROM warehouse_product
+				WHERE product_id = $1 AND (quantity > 0 OR reserved_quantity > 0 OR in_transit_quantity > 0)
+			),
+			EXISTS (SELECT 1 FROM backorders WHERE product_id = $1 AND status = $2)
+			OR EXISTS (
+				SELECT 1 FROM transfer_lines tl JOIN transfers t ON t.id = tl.transfer_id
+				WHERE tl.product_id = $1 AND t.status IN ($3, $4)
+			)
+			OR EXISTS (
+				SELECT 1 FROM reservation_lines rl JOIN reservations r ON r.id = rl.reservation_id
+				WHERE rl.product_id = $1 AND r.status = $5
+			)`,
+		input.ID, models.BackorderPending, models.TransferCreated, models.TransferDispatched, models.ReservationActive).
+		Scan(&stocked, &pending)
+	if err != nil {
+		return fmt.Errorf("failed to check product stock: %w", err)
+	}
+	if stocked {
+		err = fmt.Errorf("product %d still has stock, reserves or goods in transit: %w", input.ID, ErrConflict)
+		return err
+	}
+	if pending {
+		err = fmt.Errorf("product %d has pending backorders, open transfers or active reservations: %w", input.ID, ErrConflict)
+		return err
+	}
+
 	deleteQuery := squirrel.Delete("products").Where(squirrel.Eq{"id": input.ID}).RunWith(tx).PlaceholderFormat(squirrel.Dollar)
 	query, args, err := deleteQuery.ToSql()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to delete product: %v", err)
+		return fmt.Errorf("failed to delete product: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete product: %w", err)
+	}
+	if deleted == 0 {
+		err = fmt.Errorf("no product with ID: %d: %w", input.ID, ErrNotFound)
+		return err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
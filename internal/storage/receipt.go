@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+type ReceiptRepo struct {
+	db *sql.DB
+}
+
+func NewReceiptRepo(db *sql.DB) *ReceiptRepo {
+	return &ReceiptRepo{
+		db: db,
+	}
+}
+
+// CreateReceipt adds the received lines to the stock of the warehouse in one transaction.
+// The receipt number makes it idempotent: for an already received number the id of the existing
+// receipt is returned with created set to false and the stock is left unchanged, a different receipt
+// under the same number is ErrConflict.
+// The returned id is zero when some lines failed.
+func (r *ReceiptRepo) CreateReceipt(ctx context.Context, input models.CreateReceiptInput) (int, bool, []models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM warehouses WHERE id = $1)", input.WarehouseID).Scan(&exists)
+	if err != nil {
+		return 0, false, nil, fmt.Errorf("failed to check warehouse: %w", err)
+	}
+	if !exists {
+		err = fmt.Errorf("no warehouse with ID: %d: %w", input.WarehouseID, ErrNotFound)
+		return 0, false, nil, err
+	}
+
+	// A concurrent receipt with the same number waits on the unique index here
+	// and then sees the committed one
+	var id int
+	err = tx.QueryRowContext(ctx, `INSERT INTO receipts (number, warehouse_id, supplier_ref) VALUES ($1, $2, $3)
+		ON CONFLICT (number) DO NOTHING RETURNING id`, input.Number, input.WarehouseID, input.SupplierRef).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		id, err = sameReceiptTx(ctx, tx, input)
+		if err != nil {
+			return 0, false, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return 0, false, nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return id, false, nil, nil
+	}
+	if err != nil {
+		return 0, false, nil, fmt.Errorf("failed to insert receipt: %w", err)
+	}
+
+	lines := make([]models.StockLine, len(input.Lines))
+	for i, line := range input.Lines {
+		line.WarehouseID = input.WarehouseID
+		lines[i] = line
+	}
+
+	failed, err := receiveStockTx(ctx, tx, lines)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return 0, false, nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return 0, false, failed, nil
+	}
+
+	for _, line := range lines {
+		lineQuery := squirrel.Insert("receipt_lines").
+			Columns("receipt_id", "product_id", "quantity").
+			Values(id, line.ProductID, line.Quantity).
+			PlaceholderFormat(squirrel.Dollar)
+
+		var query string
+		var args []interface{}
+		query, args, err = lineQuery.ToSql()
+		if err != nil {
+			return 0, false, nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, false, nil, fmt.Errorf("failed to insert receipt line: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return id, true, nil, nil
+}
+
+// sameReceiptTx returns the id of the stored receipt with the number of the input
+// or ErrConflict if its warehouse, supplier or product quantities differ from the input
+func sameReceiptTx(ctx context.Context, tx *sql.Tx, input models.CreateReceiptInput) (int, error) {
+	var id, warehouseID int
+	var supplierRef string
+	err := tx.QueryRowContext(ctx, "SELECT id, warehouse_id, supplier_ref FROM receipts WHERE number = $1", input.Number).
+		Scan(&id, &warehouseID, &supplierRef)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get receipt %s: %w", input.Number, err)
+	}
+	conflict := fmt.Errorf("receipt %s was already received with different content: %w", input.Number, ErrConflict)
+	if warehouseID != input.WarehouseID || supplierRef != input.SupplierRef {
+		return 0, conflict
+	}
+
+	lines := make([]models.StockLine, len(input.Lines))
+	copy(lines, input.Lines)
+	failed, err := resolveStockLinesTx(ctx, tx, lines)
+	if err != nil {
+		return 0, err
+	}
+	if len(failed) > 0 {
+		return 0, conflict
+	}
+
+	// Lines are compared as total quantities per product, so their order and splitting don't matter
+	quantities := make(map[int]int)
+	for _, line := range lines {
+		quantities[line.ProductID] += line.Quantity
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT product_id, SUM(quantity) FROM receipt_lines WHERE receipt_id = $1 GROUP BY product_id", id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get receipt lines: %w", err)
+	}
+	defer rows.Close()
+
+	stored := 0
+	for rows.Next() {
+		var productID, quantity int
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			return 0, fmt.Errorf("failed to scan receipt lines: %w", err)
+		}
+		if quantities[productID] != quantity {
+			return 0, conflict
+		}
+		stored++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if stored != len(quantities) {
+		return 0, conflict
+	}
+
+	return id, nil
+}
+
+func (r *ReceiptRepo) GetReceipts(ctx context.Context, filter models.GetReceiptsFilter) ([]*models.Receipt, error) {
+	var receipts []*models.Receipt
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	queryBuilder := squirrel.Select("id", "number", "warehouse_id", "supplier_ref", "created_at").
+		From("receipts").OrderBy("id").PlaceholderFormat(squirrel.Dollar)
+	if len(filter.IDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
+	}
+	if len(filter.Numbers) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"number": filter.Numbers})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*models.Receipt)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var receipt models.Receipt
+		if err = rows.Scan(&receipt.ID, &receipt.Number, &receipt.WarehouseID, &receipt.SupplierRef, &receipt.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan receipts: %w", err)
+		}
+		receipt.Lines = []models.ReceiptLine{}
+		receipts = append(receipts, &receipt)
+		byID[receipt.ID] = &receipt
+		ids = append(ids, receipt.ID)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		linesQuery := squirrel.Select("id", "receipt_id", "product_id", "quantity").
+			From("receipt_lines").
+			Where(squirrel.Eq{"receipt_id": ids}).
+			OrderBy("id").
+			PlaceholderFormat(squirrel.Dollar)
+
+		query, args, err = linesQuery.ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		var lineRows *sql.Rows
+		lineRows, err = tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer lineRows.Close()
+
+		for lineRows.Next() {
+			var line models.ReceiptLine
+			if err = lineRows.Scan(&line.ID, &line.ReceiptID, &line.ProductID, &line.Quantity); err != nil {
+				return nil, fmt.Errorf("failed to scan receipt lines: %w", err)
+			}
+			byID[line.ReceiptID].Lines = append(byID[line.ReceiptID].Lines, line)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return receipts, nil
+}
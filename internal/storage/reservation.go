@@ -0,0 +1,715 @@
+package storage
+
+import (
+	"LamodaTest/internal/allocation"
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+type ReservationRepo struct {
+	db                *sql.DB
+	checkAvailability bool
+}
+
+func NewReservationRepo(db *sql.DB, blockPolicy models.BlockPolicy) *ReservationRepo {
+	return &ReservationRepo{
+		db:                db,
+		checkAvailability: blockPolicy != models.BlockPolicyKeep,
+	}
+}
+
+// CreateReservation reserves the lines and records them as a reservation in one transaction.
+// In all_or_nothing mode nothing is reserved if any line fails; in partial mode whatever is
+// available is reserved. With input.Backorder the quantities of warehouse-bound lines that are short
+// of stock are queued as backorders of the reservation. The returned id is zero when no reservation was created.
+func (r *ReservationRepo) CreateReservation(ctx context.Context, input models.CreateReservationInput) (int, []models.StockLineResult, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	lines, origins, results, err := allocateStockLinesTx(ctx, tx, input.Lines, allocation.Strategy(input.Strategy))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var lineResults []models.StockLineResult
+	if input.Mode == models.ReservePartial {
+		lineResults, err = reservePartialTx(ctx, tx, lines, r.checkAvailability)
+	} else {
+		lineResults, err = reserveAllOrNothingTx(ctx, tx, lines, r.checkAvailability)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	complete := mergeStockLineResults(results, origins, lineResults)
+
+	reserved := make([]models.StockLine, 0, len(lineResults))
+	for _, result := range lineResults {
+		if result.Reserved > 0 {
+			reserved = append(reserved, models.StockLine{WarehouseID: result.WarehouseID, ProductID: result.ProductID, Code: result.Code, Quantity: result.Reserved})
+		}
+	}
+	var backorders []models.StockLine
+	if input.Backorder {
+		for i := range results {
+			result := &results[i]
+			if input.Lines[i].WarehouseID == 0 || result.Reason != models.ReasonInsufficientStock {
+				continue
+			}
+			result.Backordered = result.Requested - result.Reserved
+			backorders = append(backorders, models.StockLine{WarehouseID: input.Lines[i].WarehouseID, ProductID: result.ProductID,
+				Code: result.Code, Quantity: result.Backordered})
+		}
+	}
+	if len(reserved) == 0 && len(backorders) == 0 || !complete && input.Mode != models.ReservePartial {
+		for i := range results {
+			results[i].Reserved = 0
+			results[i].Backordered = 0
+			results[i].Allocations = nil
+		}
+		if err = tx.Rollback(); err != nil {
+			return 0, nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return 0, results, nil
+	}
+
+	var expiresAt interface{}
+	if input.TTL > 0 {
+		expiresAt = squirrel.Expr("NOW() + make_interval(secs => ?)", input.TTL.Seconds())
+	}
+
+	insertQuery := squirrel.Insert("reservations").
+		Columns("order_ref", "status", "expires_at").
+		Values(input.OrderRef, models.ReservationActive, expiresAt).
+		Suffix("RETURNING id").
+		RunWith(tx).PlaceholderFormat(squirrel.Dollar)
+
+	query, args, err := insertQuery.ToSql()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to insert reservation: %w", err)
+	}
+
+	for _, line := range reserved {
+		lineQuery := squirrel.Insert("reservation_lines").
+			Columns("reservation_id", "warehouse_id", "product_id", "quantity").
+			Values(id, line.WarehouseID, line.ProductID, line.Quantity).
+			PlaceholderFormat(squirrel.Dollar)
+
+		query, args, err = lineQuery.ToSql()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to insert reservation line: %w", err)
+		}
+	}
+
+	err = insertBackordersTx(ctx, tx, id, backorders)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return id, results, nil
+}
+
+// reserveAllOrNothingTx reserves every line in full; if any line fails no line is reported as reserved
+// and the caller must roll the transaction back.
+func reserveAllOrNothingTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine, checkAvailability bool) ([]models.StockLineResult, error) {
+	failed, err := reserveStockTx(ctx, tx, lines, checkAvailability)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]models.StockLineResult, len(lines))
+	for i, line := range lines {
+		results[i] = models.StockLineResult{WarehouseID: line.WarehouseID, ProductID: line.ProductID, Code: line.Code,
+			Barcode: line.Barcode, Requested: line.Quantity}
+		if len(failed) == 0 {
+			results[i].Reserved = line.Quantity
+		}
+	}
+	for _, line := range failed {
+		results[line.Line].Reason = line.Reason
+	}
+
+	return results, nil
+}
+
+// allocateStockLinesTx turns requested lines into lines bound to warehouses.
+// Lines without a warehouse are distributed over available warehouses with the strategy.
+// origins holds the index of the requested line for every returned line; results
+// holds one result per requested line with failures found during allocation.
+func allocateStockLinesTx(ctx context.Context, tx *sql.Tx, requested []models.StockLine, strategy allocation.Strategy) (
+	lines []models.StockLine, origins []int, results []models.StockLineResult, err error) {
+	results = make([]models.StockLineResult, len(requested))
+
+	var auto []models.StockLine
+	var autoOrigins []int
+	for i, line := range requested {
+		results[i] = models.StockLineResult{WarehouseID: line.WarehouseID, ProductID: line.ProductID, Code: line.Code,
+			Barcode: line.Barcode, Requested: line.Quantity}
+		if line.WarehouseID != 0 {
+			lines = append(lines, line)
+			origins = append(origins, i)
+			continue
+		}
+		auto = append(auto, line)
+		autoOrigins = append(autoOrigins, i)
+	}
+	if len(auto) == 0 {
+		return lines, origins, results, nil
+	}
+
+	failed, err := resolveStockLinesTx(ctx, tx, auto)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, line := range failed {
+		results[autoOrigins[line.Line]].Reason = line.Reason
+	}
+
+	var demands []allocation.Demand
+	var productIDs []int
+	for i, line := range auto {
+		if line.ProductID == 0 {
+			continue
+		}
+		results[autoOrigins[i]].ProductID, results[autoOrigins[i]].Code = line.ProductID, line.Code
+		demands = append(demands, allocation.Demand{Line: i, ProductID: line.ProductID, Quantity: line.Quantity})
+		productIDs = append(productIDs, line.ProductID)
+	}
+	if len(demands) == 0 {
+		return lines, origins, results, nil
+	}
+
+	stock, err := getAllocatableStockTx(ctx, tx, productIDs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	allocations, err := allocation.Allocate(strategy, demands, stock)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, a := range allocations {
+		lines = append(lines, models.StockLine{WarehouseID: a.WarehouseID, ProductID: a.ProductID, Code: auto[a.Line].Code, Quantity: a.Quantity})
+		origins = append(origins, autoOrigins[a.Line])
+	}
+
+	return lines, origins, results, nil
+}
+
+// getAllocatableStockTx returns reservable stock of the products in available warehouses.
+// Rows are not locked: the conditional reserve that follows guards against concurrent changes.
+func getAllocatableStockTx(ctx context.Context, tx *sql.Tx, productIDs []int) ([]allocation.Stock, error) {
+	var stock []allocation.Stock
+
+	query, args, err := squirrel.Select("wp.warehouse_id", "wp.product_id", "w.priority", reservableExpr("wp")).
+		From("warehouse_product wp").
+		Join("warehouses w ON w.id = wp.warehouse_id").
+		Where(squirrel.Eq{"wp.product_id": productIDs, "w.availability": true}).
+		Where(reservableExpr("wp")+" > 0").
+		OrderBy("wp.warehouse_id", "wp.product_id").
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get allocatable stock: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s allocation.Stock
+		if err := rows.Scan(&s.WarehouseID, &s.ProductID, &s.Priority, &s.Available); err != nil {
+			return nil, fmt.Errorf("failed to scan allocatable stock: %w", err)
+		}
+		stock = append(stock, s)
+	}
+
+	return stock, rows.Err()
+}
+
+// mergeStockLineResults folds results of warehouse-bound lines into the requested lines
+// and reports whether every requested line was reserved in full
+func mergeStockLineResults(results []models.StockLineResult, origins []int, lineResults []models.StockLineResult) bool {
+	for i, lineResult := range lineResults {
+		result := &results[origins[i]]
+		result.ProductID, result.Code = lineResult.ProductID, lineResult.Code
+		result.Reserved += lineResult.Reserved
+		if result.Reason == "" {
+			result.Reason = lineResult.Reason
+		}
+		if lineResult.Reserved > 0 {
+			result.Allocations = append(result.Allocations, models.StockAllocation{WarehouseID: lineResult.WarehouseID, Quantity: lineResult.Reserved})
+		}
+	}
+
+	complete := true
+	for i := range results {
+		if results[i].Reserved < results[i].Requested {
+			complete = false
+			if results[i].Reason == "" {
+				results[i].Reason = models.ReasonInsufficientStock
+			}
+		}
+	}
+	return complete
+}
+
+func (r *ReservationRepo) GetReservations(ctx context.Context, filter models.GetReservationsFilter) ([]*models.Reservation, error) {
+	var reservations []*models.Reservation
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	queryBuilder := squirrel.Select("id", "order_ref", "status", "created_at", "updated_at", "expires_at").
+		From("reservations").OrderBy("id").PlaceholderFormat(squirrel.Dollar)
+	if len(filter.IDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
+	}
+	if filter.OrderRef != "" {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"order_ref": filter.OrderRef})
+	}
+	if len(filter.Statuses) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"status": filter.Statuses})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*models.Reservation)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var reservation models.Reservation
+		if err = rows.Scan(&reservation.ID, &reservation.OrderRef, &reservation.Status, &reservation.CreatedAt, &reservation.UpdatedAt, &reservation.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan reservations: %w", err)
+		}
+		reservation.Lines = []models.ReservationLine{}
+		reservations = append(reservations, &reservation)
+		byID[reservation.ID] = &reservation
+		ids = append(ids, reservation.ID)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		linesQuery := squirrel.Select("id", "reservation_id", "warehouse_id", "product_id", "quantity", "shipped_quantity").
+			From("reservation_lines").
+			Where(squirrel.Eq{"reservation_id": ids}).
+			OrderBy("id").
+			PlaceholderFormat(squirrel.Dollar)
+
+		query, args, err = linesQuery.ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		var lineRows *sql.Rows
+		lineRows, err = tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer lineRows.Close()
+
+		for lineRows.Next() {
+			var line models.ReservationLine
+			if err = lineRows.Scan(&line.ID, &line.ReservationID, &line.WarehouseID, &line.ProductID, &line.Quantity, &line.ShippedQuantity); err != nil {
+				return nil, fmt.Errorf("failed to scan reservation lines: %w", err)
+			}
+			byID[line.ReservationID].Lines = append(byID[line.ReservationID].Lines, line)
+		}
+		lineRows.Close()
+
+		var backorders map[int][]models.Backorder
+		backorders, err = getBackordersTx(ctx, tx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for id, reservationBackorders := range backorders {
+			byID[id].Backorders = reservationBackorders
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return reservations, nil
+}
+
+func (r *ReservationRepo) ReleaseReservation(ctx context.Context, id int) error {
+	_, err := r.closeReservation(ctx, id, models.ReservationReleased)
+	return err
+}
+
+// ExpireReservations releases up to limit active reservations whose TTL has passed
+// and returns how many of them were expired.
+func (r *ReservationRepo) ExpireReservations(ctx context.Context, limit int) (int, error) {
+	query, args, err := squirrel.Select("id").From("reservations").
+		Where(squirrel.Eq{"status": models.ReservationActive}).
+		Where("expires_at <= NOW()").
+		OrderBy("expires_at").
+		Limit(uint64(limit)).
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired reservations: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, fmt.Errorf("failed to scan reservations: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	var errs []error
+	expired := 0
+	for _, id := range ids {
+		closed, err := r.closeReservation(ctx, id, models.ReservationExpired)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if closed {
+			expired++
+		}
+	}
+
+	return expired, errors.Join(errs...)
+}
+
+// MoveWarehouseReservations moves lines of active reservations out of the warehouse
+// to other available warehouses. A line is moved only if it can be placed in full,
+// otherwise it is kept. Returns the numbers of moved and kept lines.
+func (r *ReservationRepo) MoveWarehouseReservations(ctx context.Context, warehouseID int) (int, int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	query, args, err := squirrel.Select("rl.id", "rl.reservation_id", "rl.product_id", "rl.quantity - rl.shipped_quantity").
+		From("reservation_lines rl").
+		Join("reservations r ON r.id = rl.reservation_id").
+		Where(squirrel.Eq{"r.status": models.ReservationActive, "rl.warehouse_id": warehouseID}).
+		Where("rl.quantity > rl.shipped_quantity").
+		OrderBy("rl.reservation_id", "rl.id").
+		Suffix("FOR UPDATE").
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get reservation lines: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []models.ReservationLine
+	for rows.Next() {
+		line := models.ReservationLine{WarehouseID: warehouseID}
+		if err = rows.Scan(&line.ID, &line.ReservationID, &line.ProductID, &line.Quantity); err != nil {
+			return 0, 0, fmt.Errorf("failed to scan reservation lines: %w", err)
+		}
+		lines = append(lines, line)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	rows.Close()
+
+	moved, kept := 0, 0
+	for _, line := range lines {
+		var ok bool
+		ok, err = moveReservationLineTx(ctx, tx, line)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			moved++
+		} else {
+			kept++
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return moved, kept, nil
+}
+
+// moveReservationLineTx reallocates the not yet shipped part of a reservation line to other available warehouses.
+// Changes of a line that can't be moved in full are rolled back to a savepoint.
+func moveReservationLineTx(ctx context.Context, tx *sql.Tx, line models.ReservationLine) (bool, error) {
+	stock, err := getAllocatableStockTx(ctx, tx, []int{line.ProductID})
+	if err != nil {
+		return false, err
+	}
+
+	candidates := make([]allocation.Stock, 0, len(stock))
+	for _, s := range stock {
+		if s.WarehouseID != line.WarehouseID {
+			candidates = append(candidates, s)
+		}
+	}
+
+	allocations, err := allocation.Allocate(allocation.MostAvailable,
+		[]allocation.Demand{{ProductID: line.ProductID, Quantity: line.Quantity}}, candidates)
+	if err != nil {
+		return false, err
+	}
+
+	targets := make([]models.StockLine, 0, len(allocations))
+	allocated := 0
+	for _, a := range allocations {
+		targets = append(targets, models.StockLine{WarehouseID: a.WarehouseID, ProductID: a.ProductID, Quantity: a.Quantity})
+		allocated += a.Quantity
+	}
+	if allocated < line.Quantity {
+		return false, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, "SAVEPOINT move_reservation_line"); err != nil {
+		return false, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+
+	failed, err := reserveStockTx(ctx, tx, targets, true)
+	if err != nil {
+		return false, err
+	}
+	if len(failed) == 0 {
+		failed, err = releaseStockTx(ctx, tx, []models.StockLine{{WarehouseID: line.WarehouseID, ProductID: line.ProductID, Quantity: line.Quantity}})
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(failed) > 0 {
+		if _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT move_reservation_line"); err != nil {
+			return false, fmt.Errorf("failed to rollback to savepoint: %w", err)
+		}
+		return false, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE reservation_lines SET quantity = shipped_quantity WHERE id = $1", line.ID); err != nil {
+		return false, fmt.Errorf("failed to update reservation line: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM reservation_lines WHERE id = $1 AND quantity = 0", line.ID); err != nil {
+		return false, fmt.Errorf("failed to delete reservation line: %w", err)
+	}
+	for _, target := range targets {
+		_, err = tx.ExecContext(ctx, "INSERT INTO reservation_lines (reservation_id, warehouse_id, product_id, quantity) VALUES ($1, $2, $3, $4)",
+			line.ReservationID, target.WarehouseID, target.ProductID, target.Quantity)
+		if err != nil {
+			return false, fmt.Errorf("failed to insert reservation line: %w", err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT move_reservation_line"); err != nil {
+		return false, fmt.Errorf("failed to release savepoint: %w", err)
+	}
+
+	return true, nil
+}
+
+// closeReservation cancels pending backorders, returns the stock of an active reservation and moves it
+// to the given status. Expiration is skipped without an error when the reservation was closed or prolonged concurrently.
+// The reservation is locked FOR NO KEY UPDATE so that concurrent backorder fills can still add lines to it.
+func (r *ReservationRepo) closeReservation(ctx context.Context, id int, status models.ReservationStatus) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	var current models.ReservationStatus
+	var expired bool
+	err = tx.QueryRowContext(ctx, "SELECT status, COALESCE(expires_at <= NOW(), false) FROM reservations WHERE id = $1 FOR NO KEY UPDATE", id).
+		Scan(&current, &expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("no reservation with ID: %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get reservation %d: %w", id, err)
+	}
+	if status == models.ReservationExpired && (current != models.ReservationActive || !expired) {
+		err = tx.Rollback()
+		return false, err
+	}
+	if current != models.ReservationActive {
+		err = fmt.Errorf("reservation %d is %s: %w", id, current, ErrConflict)
+		return false, err
+	}
+
+	err = cancelBackordersTx(ctx, tx, id)
+	if err != nil {
+		return false, err
+	}
+
+	err = releaseReservationLinesTx(ctx, tx, id)
+	if err != nil {
+		return false, err
+	}
+
+	err = setReservationStatusTx(ctx, tx, id, status)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
+
+// releaseReservationLinesTx returns the reserved quantities of all reservation lines back to the stock.
+func releaseReservationLinesTx(ctx context.Context, tx *sql.Tx, id int) error {
+	lines, err := getReservationStockLinesTx(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	failed, err := releaseStockTx(ctx, tx, lines)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot release reservation %d: product %d in warehouse %d: %s",
+			id, failed[0].ProductID, failed[0].WarehouseID, failed[0].Reason)
+	}
+
+	return nil
+}
+
+// getReservationStockLinesTx returns the not yet shipped quantities of the reservation lines
+func getReservationStockLinesTx(ctx context.Context, tx *sql.Tx, id int) ([]models.StockLine, error) {
+	var lines []models.StockLine
+
+	query, args, err := squirrel.Select("warehouse_id", "product_id", "quantity - shipped_quantity").
+		From("reservation_lines").
+		Where(squirrel.Eq{"reservation_id": id}).
+		Where("quantity > shipped_quantity").
+		OrderBy("id").
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation lines: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line models.StockLine
+		if err := rows.Scan(&line.WarehouseID, &line.ProductID, &line.Quantity); err != nil {
+			return nil, fmt.Errorf("failed to scan reservation lines: %w", err)
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+func setReservationStatusTx(ctx context.Context, tx *sql.Tx, id int, status models.ReservationStatus) error {
+	updateQuery := squirrel.Update("reservations").
+		Set("status", status).
+		Set("updated_at", squirrel.Expr("NOW()")).
+		Where(squirrel.Eq{"id": id}).
+		PlaceholderFormat(squirrel.Dollar)
+
+	query, args, err := updateQuery.ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update reservation status: %w", err)
+	}
+
+	return nil
+}
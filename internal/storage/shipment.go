@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+type ShipmentRepo struct {
+	db *sql.DB
+}
+
+func NewShipmentRepo(db *sql.DB) *ShipmentRepo {
+	return &ShipmentRepo{
+		db: db,
+	}
+}
+
+// shipmentPart is a quantity shipped from a single reservation line
+type shipmentPart struct {
+	reservationLineID int
+	line              models.StockLine
+}
+
+// CreateShipment ships reserved stock of an active reservation: quantity and reserved_quantity
+// are decreased together, shipped quantities are recorded on the reservation lines and the
+// reservation becomes fulfilled once nothing is left to ship and no backorder is pending.
+// The returned id is zero when some lines failed.
+func (r *ShipmentRepo) CreateShipment(ctx context.Context, input models.CreateShipmentInput) (int, []models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	var status models.ReservationStatus
+	err = tx.QueryRowContext(ctx, "SELECT status FROM reservations WHERE id = $1 FOR NO KEY UPDATE", input.ReservationID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, fmt.Errorf("no reservation with ID: %d: %w", input.ReservationID, ErrNotFound)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get reservation %d: %w", input.ReservationID, err)
+	}
+	if status != models.ReservationActive {
+		err = fmt.Errorf("reservation %d is %s: %w", input.ReservationID, status, ErrConflict)
+		return 0, nil, err
+	}
+
+	parts, failed, err := planShipmentTx(ctx, tx, input)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(failed) == 0 && len(parts) == 0 {
+		err = fmt.Errorf("reservation %d has nothing to ship: %w", input.ReservationID, ErrConflict)
+		return 0, nil, err
+	}
+
+	if len(failed) == 0 {
+		lines := make([]models.StockLine, len(parts))
+		for i, part := range parts {
+			lines[i] = part.line
+		}
+		failed, err = shipStockTx(ctx, tx, lines)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return 0, nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return 0, failed, nil
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, "INSERT INTO shipments (reservation_id) VALUES ($1) RETURNING id", input.ReservationID).Scan(&id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to insert shipment: %w", err)
+	}
+
+	for _, part := range parts {
+		_, err = tx.ExecContext(ctx, "UPDATE reservation_lines SET shipped_quantity = shipped_quantity + $1 WHERE id = $2",
+			part.line.Quantity, part.reservationLineID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to update reservation line: %w", err)
+		}
+
+		lineQuery := squirrel.Insert("shipment_lines").
+			Columns("shipment_id", "warehouse_id", "product_id", "quantity").
+			Values(id, part.line.WarehouseID, part.line.ProductID, part.line.Quantity).
+			PlaceholderFormat(squirrel.Dollar)
+
+		var query string
+		var args []interface{}
+		query, args, err = lineQuery.ToSql()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to insert shipment line: %w", err)
+		}
+	}
+
+	var remaining bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM reservation_lines WHERE reservation_id = $1 AND quantity > shipped_quantity)
+		OR EXISTS(SELECT 1 FROM backorders WHERE reservation_id = $1 AND status = $2)`,
+		input.ReservationID, models.BackorderPending).Scan(&remaining)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to check reservation lines: %w", err)
+	}
+	if !remaining {
+		err = setReservationStatusTx(ctx, tx, input.ReservationID, models.ReservationFulfilled)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return id, nil, nil
+}
+
+// planShipmentTx distributes the requested lines over not yet shipped reservation lines.
+// Without requested lines everything not yet shipped is planned. A requested line
+// without a warehouse matches the product in any warehouse of the reservation.
+func planShipmentTx(ctx context.Context, tx *sql.Tx, input models.CreateShipmentInput) ([]shipmentPart, []models.FailedStockLine, error) {
+	query, args, err := squirrel.Select("id", "warehouse_id", "product_id", "quantity - shipped_quantity").
+		From("reservation_lines").
+		Where(squirrel.Eq{"reservation_id": input.ReservationID}).
+		Where("quantity > shipped_quantity").
+		OrderBy("id").
+		Suffix("FOR UPDATE").
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get reservation lines: %w", err)
+	}
+	defer rows.Close()
+
+	var available []shipmentPart
+	for rows.Next() {
+		var part shipmentPart
+		if err := rows.Scan(&part.reservationLineID, &part.line.WarehouseID, &part.line.ProductID, &part.line.Quantity); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan reservation lines: %w", err)
+		}
+		available = append(available, part)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+
+	if len(input.Lines) == 0 {
+		return available, nil, nil
+	}
+
+	failed, err := resolveStockLinesTx(ctx, tx, input.Lines)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var parts []shipmentPart
+	for i, line := range input.Lines {
+		if line.ProductID == 0 {
+			continue
+		}
+
+		remaining := line.Quantity
+		for j := range available {
+			candidate := &available[j]
+			if remaining == 0 {
+				break
+			}
+			if candidate.line.ProductID != line.ProductID || candidate.line.Quantity == 0 ||
+				line.WarehouseID != 0 && candidate.line.WarehouseID != line.WarehouseID {
+				continue
+			}
+
+			quantity := min(remaining, candidate.line.Quantity)
+			candidate.line.Quantity -= quantity
+			remaining -= quantity
+
+			part := *candidate
+			part.line.Quantity = quantity
+			parts = append(parts, part)
+		}
+		if remaining > 0 {
+			failed = append(failed, models.FailedStockLine{StockLine: line, Line: i, Reason: models.ReasonExceedsReservation})
+		}
+	}
+
+	return parts, failed, nil
+}
+
+func (r *ShipmentRepo) GetShipments(ctx context.Context, filter models.GetShipmentsFilter) ([]*models.Shipment, error) {
+	var shipments []*models.Shipment
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	queryBuilder := squirrel.Select("id", "reservation_id", "created_at").
+		From("shipments").OrderBy("id").PlaceholderFormat(squirrel.Dollar)
+	if len(filter.IDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
+	}
+	if filter.ReservationID != 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"reservation_id": filter.ReservationID})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*models.Shipment)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var shipment models.Shipment
+		if err = rows.Scan(&shipment.ID, &shipment.ReservationID, &shipment.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan shipments: %w", err)
+		}
+		shipment.Lines = []models.ShipmentLine{}
+		shipments = append(shipments, &shipment)
+		byID[shipment.ID] = &shipment
+		ids = append(ids, shipment.ID)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		linesQuery := squirrel.Select("id", "shipment_id", "warehouse_id", "product_id", "quantity").
+			From("shipment_lines").
+			Where(squirrel.Eq{"shipment_id": ids}).
+			OrderBy("id").
+			PlaceholderFormat(squirrel.Dollar)
+
+		query, args, err = linesQuery.ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		var lineRows *sql.Rows
+		lineRows, err = tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer lineRows.Close()
+
+		for lineRows.Next() {
+			var line models.ShipmentLine
+			if err = lineRows.Scan(&line.ID, &line.ShipmentID, &line.WarehouseID, &line.ProductID, &line.Quantity); err != nil {
+				return nil, fmt.Errorf("failed to scan shipment lines: %w", err)
+			}
+			byID[line.ShipmentID].Lines = append(byID[line.ShipmentID].Lines, line)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return shipments, nil
+}
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+type StocktakeRepo struct {
+	db *sql.DB
+}
+
+func NewStocktakeRepo(db *sql.DB) *StocktakeRepo {
+	return &StocktakeRepo{
+		db: db,
+	}
+}
+
+// CreateStocktake opens a count session for the warehouse, a warehouse has at most one open session
+func (r *StocktakeRepo) CreateStocktake(ctx context.Context, warehouseID int) (int, error) {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM warehouses WHERE id = $1)", warehouseID).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check warehouse: %w", err)
+	}
+	if !exists {
+		return 0, fmt.Errorf("no warehouse with ID: %d: %w", warehouseID, ErrNotFound)
+	}
+
+	var id int
+	err = r.db.QueryRowContext(ctx, `INSERT INTO stocktakes (warehouse_id) VALUES ($1)
+		ON CONFLICT (warehouse_id) WHERE status = 'open' DO NOTHING RETURNING id`, warehouseID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("warehouse %d already has an open stocktake: %w", warehouseID, ErrConflict)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert stocktake: %w", err)
+	}
+
+	return id, nil
+}
+
+// SubmitStocktakeCounts stores counted quantities of an open stocktake. Counts with unknown
+// product codes are returned as failed and nothing is stored.
+func (r *StocktakeRepo) SubmitStocktakeCounts(ctx context.Context, input models.SubmitStocktakeCountsInput) ([]models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	warehouseID, err := lockOpenStocktakeTx(ctx, tx, input.StocktakeID)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]models.StockLine, len(input.Counts))
+	for i, count := range input.Counts {
+		lines[i] = models.StockLine{WarehouseID: warehouseID, Code: count.Code, Quantity: count.Quantity}
+	}
+
+	failed, err := resolveStockLinesTx(ctx, tx, lines)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return failed, nil
+	}
+
+	for i, line := range lines {
+		_, err = tx.ExecContext(ctx, `INSERT INTO stocktake_lines (stocktake_id, product_id, counted_quantity, reason)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (stocktake_id, product_id) DO UPDATE SET counted_quantity = EXCLUDED.counted_quantity, reason = EXCLUDED.reason`,
+			input.StocktakeID, line.ProductID, line.Quantity, input.Counts[i].Reason)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert stocktake line: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil, nil
+}
+
+// GetStocktakeVariance compares the counted quantities of the stocktake with the current stock.
+// Products that were not counted are not part of the report.
+func (r *StocktakeRepo) GetStocktakeVariance(ctx context.Context, id int) ([]models.StocktakeVariance, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT sl.product_id, p.code, sl.counted_quantity,
+			COALESCE(wp.quantity, 0), COALESCE(wp.reserved_quantity, 0), sl.reason
+		FROM stocktake_lines sl
+		JOIN stocktakes s ON s.id = sl.stocktake_id
+		JOIN products p ON p.id = sl.product_id
+		LEFT JOIN warehouse_product wp ON wp.warehouse_id = s.warehouse_id AND wp.product_id = sl.product_id
+		WHERE sl.stocktake_id = $1
+		ORDER BY sl.id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stocktake variance: %w", err)
+	}
+	defer rows.Close()
+
+	variances := make([]models.StocktakeVariance, 0)
+	for rows.Next() {
+		var v models.StocktakeVariance
+		if err := rows.Scan(&v.ProductID, &v.Code, &v.CountedQuantity, &v.Quantity, &v.ReservedQuantity, &v.Reason); err != nil {
+			return nil, fmt.Errorf("failed to scan stocktake variance: %w", err)
+		}
+		v.Variance = v.CountedQuantity - v.Quantity
+		variances = append(variances, v)
+	}
+
+	return variances, rows.Err()
+}
+
+// ApplyStocktake sets quantity of every counted product to the counted quantity in one transaction
+// and records the variance as an adjustment with the reason of the count. Without override counts below
+// reserved_quantity fail with ReasonBelowReserved and nothing is applied; with override the reservations
+// are kept and may exceed the stock.
+func (r *StocktakeRepo) ApplyStocktake(ctx context.Context, id int, override bool) ([]models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	warehouseID, err := lockOpenStocktakeTx(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT sl.product_id, p.code, sl.counted_quantity, sl.reason FROM stocktake_lines sl
+		JOIN products p ON p.id = sl.product_id
+		WHERE sl.stocktake_id = $1 ORDER BY sl.id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stocktake lines: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []models.StockLine
+	var reasons []string
+	for rows.Next() {
+		line := models.StockLine{WarehouseID: warehouseID}
+		var reason string
+		if err = rows.Scan(&line.ProductID, &line.Code, &line.Quantity, &reason); err != nil {
+			return nil, fmt.Errorf("failed to scan stocktake lines: %w", err)
+		}
+		lines = append(lines, line)
+		reasons = append(reasons, reason)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	var failed []models.FailedStockLine
+	var raised []models.StockLine
+	for _, i := range lockOrder(lines) {
+		line := lines[i]
+
+		var quantity, reserved int
+		err = tx.QueryRowContext(ctx, `SELECT quantity, reserved_quantity FROM warehouse_product
+			WHERE warehouse_id = $1 AND product_id = $2 FOR UPDATE`, line.WarehouseID, line.ProductID).Scan(&quantity, &reserved)
+		missing := errors.Is(err, sql.ErrNoRows)
+		if err != nil && !missing {
+			return nil, fmt.Errorf("failed to lock warehouse product: %w", err)
+		}
+		err = nil
+
+		if line.Quantity < reserved && !override {
+			failed = append(failed, models.FailedStockLine{StockLine: line, Line: i, Reason: models.ReasonBelowReserved})
+			continue
+		}
+		if line.Quantity == quantity {
+			continue
+		}
+
+		if missing {
+			var query string
+			var args []interface{}
+			query, args, err = insertWPQuery(models.WarehouseProduct{WarehouseID: line.WarehouseID, ProductID: line.ProductID, Quantity: line.Quantity}).ToSql()
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.ExecContext(ctx, query, args...)
+		} else {
+			_, err = tx.ExecContext(ctx, "UPDATE warehouse_product SET quantity = $1 WHERE warehouse_id = $2 AND product_id = $3",
+				line.Quantity, line.WarehouseID, line.ProductID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update warehouse product: %w", err)
+		}
+		if line.Quantity > quantity {
+			raised = append(raised, line)
+		}
+
+		err = recordStockMovementTx(ctx, tx, models.StockMovement{
+			WarehouseID:   line.WarehouseID,
+			ProductID:     line.ProductID,
+			Type:          models.MovementAdjust,
+			QuantityDelta: line.Quantity - quantity,
+			Reason:        reasons[i],
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return failed, nil
+	}
+
+	if err = fillBackordersTx(ctx, tx, raised); err != nil {
+		return nil, err
+	}
+
+	err = setStocktakeStatusTx(ctx, tx, id, models.StocktakeApplied)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (r *StocktakeRepo) CancelStocktake(ctx context.Context, id int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	_, err = lockOpenStocktakeTx(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = setStocktakeStatusTx(ctx, tx, id, models.StocktakeCancelled)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// lockOpenStocktakeTx locks the stocktake and returns its warehouse, failing unless the stocktake is open
+func lockOpenStocktakeTx(ctx context.Context, tx *sql.Tx, id int) (int, error) {
+	var warehouseID int
+	var status models.StocktakeStatus
+	err := tx.QueryRowContext(ctx, "SELECT warehouse_id, status FROM stocktakes WHERE id = $1 FOR UPDATE", id).Scan(&warehouseID, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no stocktake with ID: %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get stocktake %d: %w", id, err)
+	}
+	if status != models.StocktakeOpen {
+		return 0, fmt.Errorf("stocktake %d is %s: %w", id, status, ErrConflict)
+	}
+
+	return warehouseID, nil
+}
+
+func setStocktakeStatusTx(ctx context.Context, tx *sql.Tx, id int, status models.StocktakeStatus) error {
+	_, err := tx.ExecContext(ctx, "UPDATE stocktakes SET status = $1, updated_at = NOW() WHERE id = $2", status, id)
+	if err != nil {
+		return fmt.Errorf("failed to update stocktake status: %w", err)
+	}
+
+	return nil
+}
+
+func (r *StocktakeRepo) GetStocktakes(ctx context.Context, filter models.GetStocktakesFilter) ([]*models.Stocktake, error) {
+	var stocktakes []*models.Stocktake
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	queryBuilder := squirrel.Select("id", "warehouse_id", "status", "created_at", "updated_at").
+		From("stocktakes").OrderBy("id").PlaceholderFormat(squirrel.Dollar)
+	if len(filter.IDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
+	}
+	if filter.WarehouseID != 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"warehouse_id": filter.WarehouseID})
+	}
+	if len(filter.Statuses) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"status": filter.Statuses})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*models.Stocktake)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var stocktake models.Stocktake
+		if err = rows.Scan(&stocktake.ID, &stocktake.WarehouseID, &stocktake.Status, &stocktake.CreatedAt, &stocktake.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan stocktakes: %w", err)
+		}
+		stocktake.Lines = []models.StocktakeLine{}
+		stocktakes = append(stocktakes, &stocktake)
+		byID[stocktake.ID] = &stocktake
+		ids = append(ids, stocktake.ID)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		linesQuery := squirrel.Select("id", "stocktake_id", "product_id", "counted_quantity", "reason").
+			From("stocktake_lines").
+			Where(squirrel.Eq{"stocktake_id": ids}).
+			OrderBy("id").
+			PlaceholderFormat(squirrel.Dollar)
+
+		query, args, err = linesQuery.ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		var lineRows *sql.Rows
+		lineRows, err = tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer lineRows.Close()
+
+		for lineRows.Next() {
+			var line models.StocktakeLine
+			if err = lineRows.Scan(&line.ID, &line.StocktakeID, &line.ProductID, &line.CountedQuantity, &line.Reason); err != nil {
+				return nil, fmt.Errorf("failed to scan stocktake lines: %w", err)
+			}
+			byID[line.StocktakeID].Lines = append(byID[line.StocktakeID].Lines, line)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return stocktakes, nil
+}
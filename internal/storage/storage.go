@@ -4,41 +4,150 @@ import (
 	"LamodaTest/internal/models"
 	"context"
 	"database/sql"
+	"time"
 )
 
 type WarehouseStorage interface {
 	CreateWarehouse(ctx context.Context, wh models.Warehouse) (int, error)
-	GetWarehouses(ctx context.Context, filter models.GetWarehousesFilter) ([]*models.Warehouse, error)
+	GetWarehouses(ctx context.Context, filter models.GetWarehousesFilter) ([]*models.Warehouse, string, error)
 	UpdateWarehouse(ctx context.Context, input *models.UpdateWarehouseInput) error
 	DeleteWarehouse(ctx context.Context, wh models.DeleteWarehouseInput) error
 }
 
 type ProductStorage interface {
 	CreateProduct(ctx context.Context, p models.Product) (int, error)
-	GetProducts(ctx context.Context, filter models.GetProductsFilter) ([]*models.Product, error)
+	GetProducts(ctx context.Context, filter models.GetProductsFilter) ([]*models.Product, string, error)
+	SearchProducts(ctx context.Context, filter models.SearchProductsFilter) ([]*models.ProductSearchResult, error)
 	UpdateProduct(ctx context.Context, input *models.UpdateProductInput) error
 	DeleteProduct(ctx context.Context, input models.DeleteProductInput) error
 }
 
+type PackStorage interface {
+	SetPack(ctx context.Context, pack models.ProductPack) error
+	GetPacks(ctx context.Context, productID int) ([]*models.ProductPack, error)
+	DeletePack(ctx context.Context, productID int, name string) error
+	ConvertPacks(ctx context.Context, lines []models.StockLine) ([]models.FailedStockLine, error)
+}
+
+type BarcodeStorage interface {
+	AddBarcodes(ctx context.Context, productID int, barcodes []string) error
+	GetBarcodes(ctx context.Context, filter models.GetBarcodesFilter) ([]*models.ProductBarcode, error)
+	DeleteBarcode(ctx context.Context, barcode string) error
+}
+
+type StyleStorage interface {
+	CreateStyle(ctx context.Context, style models.Style) (int, error)
+	GetStyles(ctx context.Context, filter models.GetStylesFilter) ([]*models.Style, string, error)
+	UpdateStyle(ctx context.Context, input *models.UpdateStyleInput) error
+	DeleteStyle(ctx context.Context, input models.DeleteStyleInput) error
+	GetStyleStock(ctx context.Context, filter models.GetStyleStockFilter) ([]*models.StyleStock, error)
+}
+
 type WarehouseProductStorage interface {
 	CreateWP(ctx context.Context, wp models.WarehouseProduct) (int, error)
-	GetWP(ctx context.Context, filter models.GetWarehouseProductFilter) ([]*models.WarehouseProduct, error)
+	GetWP(ctx context.Context, filter models.GetWarehouseProductFilter) ([]*models.WarehouseProduct, string, error)
+	GetWPAsOf(ctx context.Context, filter models.GetWarehouseProductFilter, at time.Time) ([]*models.WarehouseProduct, error)
 	GetWPByProductCode(ctx context.Context, filter models.GetWPByProductCodeFilter) (*models.WarehouseProduct, error)
 	UpdateWP(ctx context.Context, input *models.UpdateWarehouseProductInput) error
 	UpdateWPBatch(ctx context.Context, inputs []models.UpdateWarehouseProductInput) error
+	ReserveWP(ctx context.Context, lines []models.StockLine) ([]models.FailedStockLine, error)
+	ReleaseWP(ctx context.Context, lines []models.StockLine) ([]models.FailedStockLine, error)
+	AdjustWP(ctx context.Context, adjustments []models.StockAdjustment, override bool) ([]models.FailedStockLine, error)
 	DeleteWP(ctx context.Context, input models.DeleteWarehouseProductInput) error
 }
 
+type ReservationStorage interface {
+	CreateReservation(ctx context.Context, input models.CreateReservationInput) (int, []models.StockLineResult, error)
+	GetReservations(ctx context.Context, filter models.GetReservationsFilter) ([]*models.Reservation, error)
+	ReleaseReservation(ctx context.Context, id int) error
+	ExpireReservations(ctx context.Context, limit int) (int, error)
+	MoveWarehouseReservations(ctx context.Context, warehouseID int) (int, int, error)
+}
+
+type ShipmentStorage interface {
+	CreateShipment(ctx context.Context, input models.CreateShipmentInput) (int, []models.FailedStockLine, error)
+	GetShipments(ctx context.Context, filter models.GetShipmentsFilter) ([]*models.Shipment, error)
+}
+
+type ReceiptStorage interface {
+	CreateReceipt(ctx context.Context, input models.CreateReceiptInput) (int, bool, []models.FailedStockLine, error)
+	GetReceipts(ctx context.Context, filter models.GetReceiptsFilter) ([]*models.Receipt, error)
+}
+
+type TransferStorage interface {
+	CreateTransfer(ctx context.Context, input models.CreateTransferInput) (int, []models.FailedStockLine, error)
+	GetTransfers(ctx context.Context, filter models.GetTransfersFilter) ([]*models.Transfer, error)
+	DispatchTransfer(ctx context.Context, id int) ([]models.FailedStockLine, error)
+	ReceiveTransfer(ctx context.Context, id int) ([]models.FailedStockLine, error)
+	CancelTransfer(ctx context.Context, id int) ([]models.FailedStockLine, error)
+}
+
+type StocktakeStorage interface {
+	CreateStocktake(ctx context.Context, warehouseID int) (int, error)
+	GetStocktakes(ctx context.Context, filter models.GetStocktakesFilter) ([]*models.Stocktake, error)
+	SubmitStocktakeCounts(ctx context.Context, input models.SubmitStocktakeCountsInput) ([]models.FailedStockLine, error)
+	GetStocktakeVariance(ctx context.Context, id int) ([]models.StocktakeVariance, error)
+	ApplyStocktake(ctx context.Context, id int, override bool) ([]models.FailedStockLine, error)
+	CancelStocktake(ctx context.Context, id int) error
+}
+
+type MovementStorage interface {
+	GetStockMovements(ctx context.Context, filter models.GetStockMovementsFilter) ([]*models.StockMovement, string, error)
+	CreateStockSnapshot(ctx context.Context, delay time.Duration) (time.Time, int, error)
+}
+
+type AlertStorage interface {
+	EvaluateStockAlerts(ctx context.Context, keys []models.StockKey) ([]*models.StockAlert, []*models.StockAlert, error)
+	GetStockAlerts(ctx context.Context, filter models.GetStockAlertsFilter) ([]*models.StockAlert, error)
+	GetLowStock(ctx context.Context, warehouseID int) ([]*models.LowStockItem, error)
+}
+
+type EventStorage interface {
+	GetEvents(ctx context.Context, filter models.GetEventsFilter) ([]*models.Event, error)
+}
+
+type IdempotencyStorage interface {
+	CreateIdempotencyKey(ctx context.Context, key models.IdempotencyKey, inProgressTimeout time.Duration, ttl time.Duration) (bool, error)
+	GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyKey, error)
+	UpdateIdempotencyKey(ctx context.Context, input *models.UpdateIdempotencyKeyInput) error
+	DeleteIdempotencyKey(ctx context.Context, key string, owner string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, ttl time.Duration) (int, error)
+}
+
 type Storage struct {
 	WarehouseStorage
 	ProductStorage
+	BarcodeStorage
+	PackStorage
+	StyleStorage
 	WarehouseProductStorage
+	ReservationStorage
+	ShipmentStorage
+	ReceiptStorage
+	TransferStorage
+	StocktakeStorage
+	MovementStorage
+	AlertStorage
+	EventStorage
+	IdempotencyStorage
 }
 
-func NewStorage(db *sql.DB) *Storage {
+func NewStorage(db *sql.DB, blockPolicy models.BlockPolicy) *Storage {
 	return &Storage{
 		WarehouseStorage:        NewWarehouseRepo(db),
 		ProductStorage:          NewProductRepo(db),
-		WarehouseProductStorage: NewWarehouseProductRepo(db),
+		BarcodeStorage:          NewBarcodeRepo(db),
+		PackStorage:             NewPackRepo(db),
+		StyleStorage:            NewStyleRepo(db),
+		WarehouseProductStorage: NewWarehouseProductRepo(db, blockPolicy),
+		ReservationStorage:      NewReservationRepo(db, blockPolicy),
+		ShipmentStorage:         NewShipmentRepo(db),
+		ReceiptStorage:          NewReceiptRepo(db),
+		TransferStorage:         NewTransferRepo(db),
+		StocktakeStorage:        NewStocktakeRepo(db),
+		MovementStorage:         NewMovementRepo(db),
+		AlertStorage:            NewAlertRepo(db),
+		EventStorage:            NewEventRepo(db),
+		IdempotencyStorage:      NewIdempotencyRepo(db),
 	}
 }
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+type StyleRepo struct {
+	db *sql.DB
+}
+
+func NewStyleRepo(db *sql.DB) *StyleRepo {
+	return &StyleRepo{
+		db: db,
+	}
+}
+
+func (r *StyleRepo) CreateStyle(ctx context.Context, style models.Style) (int, error) {
+	insertQuery := squirrel.Insert("styles").
+		Columns("article", "name", "size_grid").
+		Values(style.Article, style.Name, style.SizeGrid).
+		Suffix("RETURNING id").
+		PlaceholderFormat(squirrel.Dollar)
+
+	query, args, err := insertQuery.ToSql()
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = r.db.QueryRowContext(ctx, query, args...).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, fmt.Errorf("style with article %s already exists: %w", style.Article, ErrConflict)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert style: %w", err)
+	}
+
+	return id, nil
+}
+
+// styleSortColumns are the sort fields of GetStyles
+var styleSortColumns = sortColumns{"id": "id", "article": "article", "name": "name"}
+
+// GetStyles returns a page of styles matching the filter and the cursor of the next page, without variants
+func (r *StyleRepo) GetStyles(ctx context.Context, filter models.GetStylesFilter) ([]*models.Style, string, error) {
+	queryBuilder := squirrel.Select("id", "article", "name", "size_grid").From("styles").PlaceholderFormat(squirrel.Dollar)
+	if len(filter.IDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
+	}
+	if len(filter.Articles) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"article": filter.Articles})
+	}
+	if filter.Name != "" {
+		queryBuilder = queryBuilder.Where(squirrel.ILike{"name": "%" + filter.Name + "%"})
+	}
+	queryBuilder, err := paginate(queryBuilder, filter.Page, styleSortColumns, "id")
+	if err != nil {
+		return nil, "", err
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get styles: %w", err)
+	}
+	defer rows.Close()
+
+	var styles []*models.Style
+	var keys []string
+	var ids []int
+	for rows.Next() {
+		var style models.Style
+		var key string
+		if err := rows.Scan(&style.ID, &style.Article, &style.Name, &style.SizeGrid, &key); err != nil {
+			return nil, "", fmt.Errorf("failed to scan styles: %w", err)
+		}
+		styles = append(styles, &style)
+		keys = append(keys, key)
+		ids = append(ids, style.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	count, next := cutPage(filter.Page, keys, ids)
+
+	return styles[:count], next, nil
+}
+
+func (r *StyleRepo) UpdateStyle(ctx context.Context, input *models.UpdateStyleInput) error {
+	updateBuilder := squirrel.Update("styles").Where(squirrel.Eq{"id": input.ID}).PlaceholderFormat(squirrel.Dollar)
+	if input.Article != nil {
+		updateBuilder = updateBuilder.Set("article", *input.Article)
+	}
+	if input.Name != nil {
+		updateBuilder = updateBuilder.Set("name", *input.Name)
+	}
+	if input.SizeGrid != nil {
+		updateBuilder = updateBuilder.Set("size_grid", *input.SizeGrid)
+	}
+
+	query, args, err := updateBuilder.ToSql()
+	if err != nil {
+		return err
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("style with this article already exists: %w", ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot update style: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot update style: %w", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("no style with ID: %d: %w", input.ID, ErrNotFound)
+	}
+
+	return nil
+}
+
+// DeleteStyle deletes a style without variants
+func (r *StyleRepo) DeleteStyle(ctx context.Context, input models.DeleteStyleInput) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM styles WHERE id = $1", input.ID)
+	if isForeignKeyViolation(err) {
+		return fmt.Errorf("style %d still has variants: %w", input.ID, ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete style: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete style: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("no style with ID: %d: %w", input.ID, ErrNotFound)
+	}
+
+	return nil
+}
+
+// GetStyleStock rolls up the stock of style variants per style and warehouse.
+// Reservable stock of a variant below zero, when its safety stock exceeds what is available, counts as zero
+func (r *StyleRepo) GetStyleStock(ctx context.Context, filter models.GetStyleStockFilter) ([]*models.StyleStock, error) {
+	queryBuilder := squirrel.Select("s.id", "s.article", "wp.warehouse_id", "COUNT(*)", "SUM(wp.quantity)",
+		"SUM(wp.reserved_quantity)", "SUM(wp.quantity - wp.reserved_quantity)",
+		fmt.Sprintf("SUM(GREATEST(%s, 0))", reservableExpr("wp"))).
+		From("styles s").
+		Join("products p ON p.style_id = s.id").
+		Join("warehouse_product wp ON wp.product_id = p.id").
+		GroupBy("s.id", "s.article", "wp.warehouse_id").
+		OrderBy("s.id", "wp.warehouse_id").
+		PlaceholderFormat(squirrel.Dollar)
+	if len(filter.StyleIDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"s.id": filter.StyleIDs})
+	}
+	if filter.WarehouseID != 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"wp.warehouse_id": filter.WarehouseID})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get style stock: %w", err)
+	}
+	defer rows.Close()
+
+	stocks := make([]*models.StyleStock, 0)
+	for rows.Next() {
+		var stock models.StyleStock
+		if err := rows.Scan(&stock.StyleID, &stock.Article, &stock.WarehouseID, &stock.Variants, &stock.Quantity,
+			&stock.ReservedQuantity, &stock.Available, &stock.Reservable); err != nil {
+			return nil, fmt.Errorf("failed to scan style stock: %w", err)
+		}
+		stocks = append(stocks, &stock)
+	}
+
+	return stocks, rows.Err()
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+)
+
+type TransferRepo struct {
+	db *sql.DB
+}
+
+func NewTransferRepo(db *sql.DB) *TransferRepo {
+	return &TransferRepo{
+		db: db,
+	}
+}
+
+// CreateTransfer creates a transfer of the lines between two available warehouses.
+// Stock is not moved until the transfer is dispatched. The returned id is zero when some lines failed.
+func (r *TransferRepo) CreateTransfer(ctx context.Context, input models.CreateTransferInput) (int, []models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	if input.SourceWarehouseID == input.DestinationWarehouseID {
+		err = fmt.Errorf("source and destination warehouses must differ: %w", ErrConflict)
+		return 0, nil, err
+	}
+	for _, warehouseID := range []int{input.SourceWarehouseID, input.DestinationWarehouseID} {
+		var exists bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM warehouses WHERE id = $1)", warehouseID).Scan(&exists)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to check warehouse: %w", err)
+		}
+		if !exists {
+			err = fmt.Errorf("no warehouse with ID: %d: %w", warehouseID, ErrNotFound)
+			return 0, nil, err
+		}
+	}
+
+	sourceLines := transferStockLines(input.Lines, input.SourceWarehouseID)
+	failed, err := checkStockLinesTx(ctx, tx, sourceLines, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	var destinationLines []models.StockLine
+	if len(failed) == 0 {
+		destinationLines = transferStockLines(sourceLines, input.DestinationWarehouseID)
+		failed, err = checkStockLinesTx(ctx, tx, destinationLines, true)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return 0, nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return 0, failed, nil
+	}
+
+	// Destination rows are created up front so that dispatch and receipt only update existing rows
+	for _, i := range lockOrder(destinationLines) {
+		line := destinationLines[i]
+		insertQuery := insertWPQuery(models.WarehouseProduct{WarehouseID: line.WarehouseID, ProductID: line.ProductID}).
+			Suffix("ON CONFLICT (warehouse_id, product_id) DO NOTHING")
+
+		var query string
+		var args []interface{}
+		query, args, err = insertQuery.ToSql()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to create warehouse product: %w", err)
+		}
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, "INSERT INTO transfers (source_warehouse_id, destination_warehouse_id) VALUES ($1, $2) RETURNING id",
+		input.SourceWarehouseID, input.DestinationWarehouseID).Scan(&id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to insert transfer: %w", err)
+	}
+
+	for _, line := range sourceLines {
+		lineQuery := squirrel.Insert("transfer_lines").
+			Columns("transfer_id", "product_id", "quantity").
+			Values(id, line.ProductID, line.Quantity).
+			PlaceholderFormat(squirrel.Dollar)
+
+		var query string
+		var args []interface{}
+		query, args, err = lineQuery.ToSql()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to insert transfer line: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return id, nil, nil
+}
+
+// DispatchTransfer removes reservable stock, see reservableExpr, from the source warehouse and puts it in transit to the destination
+func (r *TransferRepo) DispatchTransfer(ctx context.Context, id int) ([]models.FailedStockLine, error) {
+	return r.changeTransferStatus(ctx, id, models.TransferDispatched)
+}
+
+// ReceiveTransfer adds the stock in transit to the destination warehouse
+func (r *TransferRepo) ReceiveTransfer(ctx context.Context, id int) ([]models.FailedStockLine, error) {
+	return r.changeTransferStatus(ctx, id, models.TransferReceived)
+}
+
+// CancelTransfer cancels a transfer, returning the stock of a dispatched transfer to the source warehouse
+func (r *TransferRepo) CancelTransfer(ctx context.Context, id int) ([]models.FailedStockLine, error) {
+	return r.changeTransferStatus(ctx, id, models.TransferCancelled)
+}
+
+// changeTransferStatus moves the stock of the transfer according to the status change in one transaction.
+// Source and destination rows are updated together in the stable lock order. Only dispatch fails lines in blocked
+// warehouses: goods already in transit can always be received or returned, so they never get stuck when a warehouse
+// is blocked. Received and returned stock fills pending backorders.
+func (r *TransferRepo) changeTransferStatus(ctx context.Context, id int, status models.TransferStatus) ([]models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	var source, destination int
+	var current models.TransferStatus
+	err = tx.QueryRowContext(ctx, "SELECT source_warehouse_id, destination_warehouse_id, status FROM transfers WHERE id = $1 FOR UPDATE", id).
+		Scan(&source, &destination, &current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no transfer with ID: %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer %d: %w", id, err)
+	}
+
+	allowed := current == models.TransferCreated && (status == models.TransferDispatched || status == models.TransferCancelled) ||
+		current == models.TransferDispatched && (status == models.TransferReceived || status == models.TransferCancelled)
+	if !allowed {
+		err = fmt.Errorf("transfer %d is %s and cannot become %s: %w", id, current, status, ErrConflict)
+		return nil, err
+	}
+
+	lines, err := getTransferStockLinesTx(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var stockLines []models.StockLine
+	var build func(line models.StockLine) stockUpdate
+	switch {
+	case status == models.TransferDispatched:
+		stockLines = append(transferStockLines(lines, source), transferStockLines(lines, destination)...)
+		build = func(line models.StockLine) stockUpdate {
+			if line.WarehouseID == source {
+				return stockUpdate{
+					query: squirrel.Update("warehouse_product").
+						Set("quantity", squirrel.Expr("quantity - ?", line.Quantity)).
+						Where(reservableExpr("warehouse_product")+" >= ?", line.Quantity),
+					quantity: -line.Quantity,
+				}
+			}
+			return stockUpdate{
+				query: squirrel.Update("warehouse_product").
+					Set("in_transit_quantity", squirrel.Expr("in_transit_quantity + ?", line.Quantity)),
+				inTransit: line.Quantity,
+			}
+		}
+	case status == models.TransferReceived:
+		stockLines = transferStockLines(lines, destination)
+		build = func(line models.StockLine) stockUpdate {
+			return stockUpdate{
+				query: squirrel.Update("warehouse_product").
+					Set("quantity", squirrel.Expr("quantity + ?", line.Quantity)).
+					Set("in_transit_quantity", squirrel.Expr("in_transit_quantity - ?", line.Quantity)).
+					Where("in_transit_quantity >= ?", line.Quantity),
+				quantity:  line.Quantity,
+				inTransit: -line.Quantity,
+			}
+		}
+	case current == models.TransferDispatched:
+		stockLines = append(transferStockLines(lines, source), transferStockLines(lines, destination)...)
+		build = func(line models.StockLine) stockUpdate {
+			if line.WarehouseID == source {
+				return stockUpdate{
+					query: squirrel.Update("warehouse_product").
+						Set("quantity", squirrel.Expr("quantity + ?", line.Quantity)),
+					quantity: line.Quantity,
+				}
+			}
+			return stockUpdate{
+				query: squirrel.Update("warehouse_product").
+					Set("in_transit_quantity", squirrel.Expr("in_transit_quantity - ?", line.Quantity)).
+					Where("in_transit_quantity >= ?", line.Quantity),
+				inTransit: -line.Quantity,
+			}
+		}
+	}
+
+	if len(stockLines) > 0 {
+		var failed []models.FailedStockLine
+		failed, err = updateStockLinesTx(ctx, tx, stockLines, status == models.TransferDispatched, models.ReasonInsufficientStock,
+			models.MovementTransfer, build)
+		if err != nil {
+			return nil, err
+		}
+		if len(failed) > 0 {
+			for i := range failed {
+				failed[i].Line %= len(lines)
+			}
+			if err = tx.Rollback(); err != nil {
+				return nil, fmt.Errorf("failed to rollback transaction: %w", err)
+			}
+			return failed, nil
+		}
+	}
+	// Received goods and goods returned to the source by a cancel can fill pending backorders
+	switch {
+	case status == models.TransferReceived:
+		err = fillBackordersTx(ctx, tx, stockLines)
+	case current == models.TransferDispatched:
+		err = fillBackordersTx(ctx, tx, transferStockLines(lines, source))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE transfers SET status = $1, updated_at = NOW() WHERE id = $2", status, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update transfer status: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil, nil
+}
+
+// transferStockLines copies the lines into the given warehouse
+func transferStockLines(lines []models.StockLine, warehouseID int) []models.StockLine {
+	result := make([]models.StockLine, len(lines))
+	for i, line := range lines {
+		line.WarehouseID = warehouseID
+		result[i] = line
+	}
+	return result
+}
+
+func getTransferStockLinesTx(ctx context.Context, tx *sql.Tx, id int) ([]models.StockLine, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT tl.product_id, p.code, tl.quantity FROM transfer_lines tl
+		JOIN products p ON p.id = tl.product_id
+		WHERE tl.transfer_id = $1 ORDER BY tl.id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer lines: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []models.StockLine
+	for rows.Next() {
+		var line models.StockLine
+		if err := rows.Scan(&line.ProductID, &line.Code, &line.Quantity); err != nil {
+			return nil, fmt.Errorf("failed to scan transfer lines: %w", err)
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+func (r *TransferRepo) GetTransfers(ctx context.Context, filter models.GetTransfersFilter) ([]*models.Transfer, error) {
+	var transfers []*models.Transfer
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	queryBuilder := squirrel.Select("id", "source_warehouse_id", "destination_warehouse_id", "status", "created_at", "updated_at").
+		From("transfers").OrderBy("id").PlaceholderFormat(squirrel.Dollar)
+	if len(filter.IDs) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
+	}
+	if len(filter.Statuses) > 0 {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"status": filter.Statuses})
+	}
+
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*models.Transfer)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var transfer models.Transfer
+		if err = rows.Scan(&transfer.ID, &transfer.SourceWarehouseID, &transfer.DestinationWarehouseID, &transfer.Status,
+			&transfer.CreatedAt, &transfer.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan transfers: %w", err)
+		}
+		transfer.Lines = []models.TransferLine{}
+		transfers = append(transfers, &transfer)
+		byID[transfer.ID] = &transfer
+		ids = append(ids, transfer.ID)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		linesQuery := squirrel.Select("id", "transfer_id", "product_id", "quantity").
+			From("transfer_lines").
+			Where(squirrel.Eq{"transfer_id": ids}).
+			OrderBy("id").
+			PlaceholderFormat(squirrel.Dollar)
+
+		query, args, err = linesQuery.ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		var lineRows *sql.Rows
+		lineRows, err = tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer lineRows.Close()
+
+		for lineRows.Next() {
+			var line models.TransferLine
+			if err = lineRows.Scan(&line.ID, &line.TransferID, &line.ProductID, &line.Quantity); err != nil {
+				return nil, fmt.Errorf("failed to scan transfer lines: %w", err)
+			}
+			byID[line.TransferID].Lines = append(byID[line.TransferID].Lines, line)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return transfers, nil
+}
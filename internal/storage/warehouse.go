@@ -4,6 +4,7 @@ import (
 	"LamodaTest/internal/models"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/Masterminds/squirrel"
 )
@@ -33,8 +34,8 @@ func (r *WarehouseRepo) CreateWarehouse(ctx context.Context, warehouse models.Wa
 	}()
 
 	insertQuery := squirrel.Insert("warehouses").
-		Columns("name", "availability").
-		Values(warehouse.Name, warehouse.Availability).
+		Columns("name", "availability", "priority", "safety_stock").
+		Values(warehouse.Name, warehouse.Availability, warehouse.Priority, warehouse.SafetyStock).
 		Suffix("RETURNING id").
 		RunWith(tx).PlaceholderFormat(squirrel.Dollar)
 
@@ -57,12 +58,18 @@ func (r *WarehouseRepo) CreateWarehouse(ctx context.Context, warehouse models.Wa
 	return id, nil
 }
 
-func (r *WarehouseRepo) GetWarehouses(ctx context.Context, filter models.GetWarehousesFilter) ([]*models.Warehouse, error) {
+// warehouseSortColumns are the sort fields of GetWarehouses
+var warehouseSortColumns = sortColumns{"id": "id", "name": "name", "priority": "priority"}
+
+// GetWarehouses returns a page of warehouses matching the filter and the cursor of the next page
+func (r *WarehouseRepo) GetWarehouses(ctx context.Context, filter models.GetWarehousesFilter) ([]*models.Warehouse, string, error) {
 	var warehouses []*models.Warehouse
+	var keys []string
+	var ids []int
 
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	defer func() {
@@ -74,42 +81,57 @@ func (r *WarehouseRepo) GetWarehouses(ctx context.Context, filter models.GetWare
 		}
 	}()
 
-	queryBuilder := squirrel.Select("id", "name", "availability").From("warehouses").RunWith(tx).PlaceholderFormat(squirrel.Dollar)
+	queryBuilder := squirrel.Select("id", "name", "availability", "priority", "safety_stock").From("warehouses").RunWith(tx).PlaceholderFormat(squirrel.Dollar)
 	if len(filter.IDs) > 0 {
 		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
 	}
+	if filter.Name != "" {
+		queryBuilder = queryBuilder.Where(squirrel.ILike{"name": "%" + filter.Name + "%"})
+	}
+	if filter.Availability != nil {
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"availability": *filter.Availability})
+	}
+	queryBuilder, err = paginate(queryBuilder, filter.Page, warehouseSortColumns, "id")
+	if err != nil {
+		return nil, "", err
+	}
 	query, args, err := queryBuilder.ToSql()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	defer rows.Close()
 
 	for rows.Next() {
 		var warehouse models.Warehouse
-		if err := rows.Scan(&warehouse.ID, &warehouse.Name, &warehouse.Availability); err != nil {
-			return nil, fmt.Errorf("failed to scan warehouses: %v", err)
+		var key string
+		if err := rows.Scan(&warehouse.ID, &warehouse.Name, &warehouse.Availability, &warehouse.Priority, &warehouse.SafetyStock, &key); err != nil {
+			return nil, "", fmt.Errorf("failed to scan warehouses: %w", err)
 		}
 		warehouses = append(warehouses, &warehouse)
+		keys = append(keys, key)
+		ids = append(ids, warehouse.ID)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return warehouses, nil
+	count, next := cutPage(filter.Page, keys, ids)
+
+	return warehouses[:count], next, nil
 }
 
 func (r *WarehouseRepo) UpdateWarehouse(ctx context.Context, input *models.UpdateWarehouseInput) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -128,24 +150,48 @@ func (r *WarehouseRepo) UpdateWarehouse(ctx context.Context, input *models.Updat
 	if input.Availability != nil {
 		updateBuilder = updateBuilder.Set("availability", *input.Availability)
 	}
+	if input.Priority != nil {
+		updateBuilder = updateBuilder.Set("priority", *input.Priority)
+	}
+	if input.SafetyStock != nil {
+		updateBuilder = updateBuilder.Set("safety_stock", *input.SafetyStock)
+	}
 	query, args, err := updateBuilder.ToSql()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("cannot update warehouse: %v", err)
+		return fmt.Errorf("cannot update warehouse: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot update warehouse: %w", err)
+	}
+	if updated == 0 {
+		err = fmt.Errorf("no warehouse with ID: %d: %w", input.ID, ErrNotFound)
+		return err
+	}
+
+	// An unblocked warehouse or a lower safety stock can make stock reservable for pending backorders
+	if input.Availability != nil && *input.Availability || input.SafetyStock != nil {
+		if err = fillWarehouseBackordersTx(ctx, tx, input.ID); err != nil {
+			return err
+		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
 
+// DeleteWarehouse deletes the warehouse with everything that references it.
+// A warehouse that still has stock, reserves, goods in transit, pending backorders
+// or open transfers and reservations can't be deleted
 func (r *WarehouseRepo) DeleteWarehouse(ctx context.Context, input models.DeleteWarehouseInput) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -160,20 +206,73 @@ func (r *WarehouseRepo) DeleteWarehouse(ctx context.Context, input models.Delete
 		}
 	}()
 
+	// The warehouse row is locked before its stock rows, in the same order as stock operations
+	// lock them, so nothing can be reserved, received or transferred between the check and the delete
+	var locked int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM warehouses WHERE id = $1 FOR UPDATE", input.ID).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("no warehouse with ID: %d: %w", input.ID, ErrNotFound)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock warehouse: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "SELECT 1 FROM warehouse_product WHERE warehouse_id = $1 ORDER BY product_id FOR UPDATE", input.ID)
+	if err != nil {
+		return fmt.Errorf("failed to lock warehouse stock: %w", err)
+	}
+
+	var stocked, pending bool
+	err = tx.QueryRowContext(ctx, `SELECT
+			EXISTS (
+				SELECT 1 FROM warehouse_product
+				WHERE warehouse_id = $1 AND (quantity > 0 OR reserved_quantity > 0 OR in_transit_quantity > 0)
+			),
+			EXISTS (SELECT 1 FROM backorders WHERE warehouse_id = $1 AND status = $2)
+			OR EXISTS (
+				SELECT 1 FROM transfers
+				WHERE (source_warehouse_id = $1 OR destination_warehouse_id = $1) AND status IN ($3, $4)
+			)
+			OR EXISTS (
+				SELECT 1 FROM reservation_lines rl JOIN reservations r ON r.id = rl.reservation_id
+				WHERE rl.warehouse_id = $1 AND r.status = $5
+			)`,
+		input.ID, models.BackorderPending, models.TransferCreated, models.TransferDispatched, models.ReservationActive).
+		Scan(&stocked, &pending)
+	if err != nil {
+		return fmt.Errorf("failed to check warehouse stock: %w", err)
+	}
+	if stocked {
+		err = fmt.Errorf("warehouse %d still has stock, reserves or goods in transit: %w", input.ID, ErrConflict)
+		return err
+	}
+	if pending {
+		err = fmt.Errorf("warehouse %d has pending backorders, open transfers or active reservations: %w", input.ID, ErrConflict)
+		return err
+	}
+
 	deleteQuery := squirrel.Delete("warehouses").Where(squirrel.Eq{"id": input.ID}).RunWith(tx).PlaceholderFormat(squirrel.Dollar)
 	query, args, err := deleteQuery.ToSql()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to execute transaction: %v", err)
+		return fmt.Errorf("failed to execute transaction: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to execute transaction: %w", err)
+	}
+	if deleted == 0 {
+		err = fmt.Errorf("no warehouse with ID: %d: %w", input.ID, ErrNotFound)
+		return err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
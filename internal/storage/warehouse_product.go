@@ -4,24 +4,30 @@ import (
 	"LamodaTest/internal/models"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	"sort"
+	"time"
 )
 
 type WarehouseProductRepo struct {
-	db *sql.DB
+	db                *sql.DB
+	checkAvailability bool
 }
 
-func NewWarehouseProductRepo(db *sql.DB) *WarehouseProductRepo {
+func NewWarehouseProductRepo(db *sql.DB, blockPolicy models.BlockPolicy) *WarehouseProductRepo {
 	return &WarehouseProductRepo{
-		db: db,
+		db:                db,
+		checkAvailability: blockPolicy != models.BlockPolicyKeep,
 	}
 }
 
 func (r *WarehouseProductRepo) CreateWP(ctx context.Context, wp models.WarehouseProduct) (int, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -33,11 +39,9 @@ func (r *WarehouseProductRepo) CreateWP(ctx context.Context, wp models.Warehouse
 		}
 	}()
 
-	insertQuery := squirrel.Insert("warehouse_product").
-		Columns("warehouse_id", "product_id", "quantity", "reserved_quantity").
-		Values(wp.WarehouseID, wp.ProductID, wp.Quantity, wp.ReservedQuantity).
+	insertQuery := insertWPQuery(wp).
 		Suffix("RETURNING id").
-		RunWith(tx).PlaceholderFormat(squirrel.Dollar)
+		RunWith(tx)
 
 	query, args, err := insertQuery.ToSql()
 	if err != nil {
@@ -46,24 +50,49 @@ func (r *WarehouseProductRepo) CreateWP(ctx context.Context, wp models.Warehouse
 
 	var id int
 	err = tx.QueryRowContext(ctx, query, args...).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, fmt.Errorf("product %d is already in warehouse %d: %w", wp.ProductID, wp.WarehouseID, ErrConflict)
+	}
+	if isForeignKeyViolation(err) {
+		return 0, fmt.Errorf("no warehouse %d or product %d: %w", wp.WarehouseID, wp.ProductID, ErrNotFound)
+	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert warehouse product: %v", err)
+		return 0, fmt.Errorf("failed to insert warehouse product: %w", err)
+	}
+
+	for _, movement := range adjustMovements(models.WarehouseProduct{WarehouseID: wp.WarehouseID, ProductID: wp.ProductID}, wp) {
+		err = recordStockMovementTx(ctx, tx, movement)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return id, nil
 }
 
-func (r *WarehouseProductRepo) GetWP(ctx context.Context, filter models.GetWarehouseProductFilter) ([]*models.WarehouseProduct, error) {
+// wpSortColumns are the sort fields of GetWP
+var wpSortColumns = sortColumns{
+	"id":                "warehouse_product.id",
+	"quantity":          "warehouse_product.quantity",
+	"reserved_quantity": "warehouse_product.reserved_quantity",
+	"available":         "warehouse_product.quantity - warehouse_product.reserved_quantity",
+	"reservable":        reservableExpr("warehouse_product"),
+}
+
+// GetWP returns a page of warehouse products matching the filter and the cursor of the next page
+func (r *WarehouseProductRepo) GetWP(ctx context.Context, filter models.GetWarehouseProductFilter) ([]*models.WarehouseProduct, string, error) {
 	var warehouseProducts []*models.WarehouseProduct
+	var keys []string
+	var ids []int
 
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+		return nil, "", fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -75,42 +104,90 @@ func (r *WarehouseProductRepo) GetWP(ctx context.Context, filter models.GetWareh
 		}
 	}()
 
-	queryBuilder := squirrel.Select("id", "warehouse_id", "product_id", "quantity", "reserved_quantity").From("warehouse_product").PlaceholderFormat(squirrel.Dollar)
+	queryBuilder := squirrel.Select("warehouse_product.id", "warehouse_product.warehouse_id", "warehouse_product.product_id",
+		"warehouse_product.quantity", "warehouse_product.reserved_quantity", "warehouse_product.in_transit_quantity",
+		"warehouse_product.min_level", "warehouse_product.reorder_point", "warehouse_product.safety_stock",
+		reservableExpr("warehouse_product")).From("warehouse_product").PlaceholderFormat(squirrel.Dollar)
 	if len(filter.IDs) > 0 {
-		queryBuilder = queryBuilder.Where(squirrel.Eq{"id": filter.IDs})
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"warehouse_product.id": filter.IDs})
 	}
 	if filter.WarehouseID != 0 {
-		queryBuilder = queryBuilder.Where(squirrel.Eq{"warehouse_id": filter.WarehouseID})
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"warehouse_product.warehouse_id": filter.WarehouseID})
 	}
 	if filter.ProductID != 0 {
-		queryBuilder = queryBuilder.Where(squirrel.Eq{"product_id": filter.ProductID})
+		queryBuilder = queryBuilder.Where(squirrel.Eq{"warehouse_product.product_id": filter.ProductID})
+	}
+	if filter.MinAvailable != nil {
+		queryBuilder = queryBuilder.Where(reservableExpr("warehouse_product")+" >= ?", *filter.MinAvailable)
+	}
+	if filter.Availability != nil {
+		queryBuilder = queryBuilder.Join("warehouses ON warehouses.id = warehouse_product.warehouse_id").
+			Where(squirrel.Eq{"warehouses.availability": *filter.Availability})
+	}
+	queryBuilder, err = paginate(queryBuilder, filter.Page, wpSortColumns, "warehouse_product.id")
+	if err != nil {
+		return nil, "", err
 	}
 
 	queryBuilder = queryBuilder.RunWith(tx)
 
 	query, args, err := queryBuilder.ToSql()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		fmt.Println(query, args)
-		return nil, err
+		return nil, "", fmt.Errorf("failed to get warehouse products: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var wp models.WarehouseProduct
-		if err := rows.Scan(&wp.ID, &wp.WarehouseID, &wp.ProductID, &wp.Quantity, &wp.ReservedQuantity); err != nil {
-			return nil, fmt.Errorf("failed to scan warehouse products: %v", err)
+		var key string
+		if err := rows.Scan(&wp.ID, &wp.WarehouseID, &wp.ProductID, &wp.Quantity, &wp.ReservedQuantity, &wp.InTransitQuantity,
+			&wp.MinLevel, &wp.ReorderPoint, &wp.SafetyStock, &wp.Reservable, &key); err != nil {
+			return nil, "", fmt.Errorf("failed to scan warehouse products: %w", err)
 		}
 		warehouseProducts = append(warehouseProducts, &wp)
+		keys = append(keys, key)
+		ids = append(ids, wp.ID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	count, next := cutPage(filter.Page, keys, ids)
+
+	return warehouseProducts[:count], next, nil
+}
+
+// GetWPAsOf returns warehouse products with their quantities as of the given time, see getStockAsOfTx
+func (r *WarehouseProductRepo) GetWPAsOf(ctx context.Context, filter models.GetWarehouseProductFilter, at time.Time) ([]*models.WarehouseProduct, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	warehouseProducts, err := getStockAsOfTx(ctx, tx, filter, at)
+	if err != nil {
+		return nil, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return warehouseProducts, nil
@@ -119,7 +196,7 @@ func (r *WarehouseProductRepo) GetWP(ctx context.Context, filter models.GetWareh
 func (r *WarehouseProductRepo) GetWPByProductCode(ctx context.Context, filter models.GetWPByProductCodeFilter) (*models.WarehouseProduct, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -131,7 +208,9 @@ func (r *WarehouseProductRepo) GetWPByProductCode(ctx context.Context, filter mo
 		}
 	}()
 
-	queryBuilder := squirrel.Select("wp.*").From("warehouse_product wp").
+	queryBuilder := squirrel.Select("wp.id", "wp.warehouse_id", "wp.product_id", "wp.quantity", "wp.reserved_quantity", "wp.in_transit_quantity",
+		"wp.min_level", "wp.reorder_point", "wp.safety_stock", reservableExpr("wp")).
+		From("warehouse_product wp").
 		Join("products p ON wp.product_id = p.id").
 		Where(squirrel.Eq{"p.code": filter.ProductCode, "wp.warehouse_id": filter.WarehouseID}).
 		PlaceholderFormat(squirrel.Dollar).
@@ -147,14 +226,18 @@ func (r *WarehouseProductRepo) GetWPByProductCode(ctx context.Context, filter mo
 	}
 
 	var wp models.WarehouseProduct
-	err = tx.QueryRowContext(ctx, query, args...).Scan(&wp.ID, &wp.WarehouseID, &wp.ProductID, &wp.Quantity, &wp.ReservedQuantity)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&wp.ID, &wp.WarehouseID, &wp.ProductID, &wp.Quantity, &wp.ReservedQuantity, &wp.InTransitQuantity,
+		&wp.MinLevel, &wp.ReorderPoint, &wp.SafetyStock, &wp.Reservable)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no warehouse product with the product code: %w", ErrNotFound)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get warehouse product by product code: %v", err)
+		return nil, fmt.Errorf("failed to get warehouse product by product code: %w", err)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return &wp, nil
@@ -163,7 +246,7 @@ func (r *WarehouseProductRepo) GetWPByProductCode(ctx context.Context, filter mo
 func (r *WarehouseProductRepo) UpdateWP(ctx context.Context, input *models.UpdateWarehouseProductInput) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -175,42 +258,87 @@ func (r *WarehouseProductRepo) UpdateWP(ctx context.Context, input *models.Updat
 		}
 	}()
 
-	updateBuilder := squirrel.Update("warehouse_product").Where(squirrel.Eq{"id": input.ID}).RunWith(tx).PlaceholderFormat(squirrel.Dollar)
-	if input.WarehouseID != nil {
-		updateBuilder = updateBuilder.Set("warehouse_id", *input.WarehouseID)
+	err = updateWPTx(ctx, tx, input)
+	if err != nil {
+		return err
 	}
-	if input.ProductID != nil {
-		updateBuilder = updateBuilder.Set("product_id", *input.ProductID)
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
-	if input.Quantity != nil {
-		updateBuilder = updateBuilder.Set("quantity", *input.Quantity)
+
+	return nil
+}
+
+func (r *WarehouseProductRepo) UpdateWPBatch(ctx context.Context, inputs []models.UpdateWarehouseProductInput) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	if input.ReservedQuantity != nil {
-		updateBuilder = updateBuilder.Set("reserved_quantity", *input.ReservedQuantity)
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	for i := range inputs {
+		err = updateWPTx(ctx, tx, &inputs[i])
+		if err != nil {
+			return err
+		}
 	}
 
-	query, args, err := updateBuilder.ToSql()
+	err = tx.Commit()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	_, err = tx.ExecContext(ctx, query, args...)
+	return nil
+}
+
+func (r *WarehouseProductRepo) ReserveWP(ctx context.Context, lines []models.StockLine) ([]models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to update warehouse product: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
+		}
+	}()
+
+	failed, err := reserveStockTx(ctx, tx, lines, r.checkAvailability)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return failed, nil
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return nil
+	return nil, nil
 }
 
-func (r *WarehouseProductRepo) UpdateWPBatch(ctx context.Context, inputs []models.UpdateWarehouseProductInput) error {
+func (r *WarehouseProductRepo) ReleaseWP(ctx context.Context, lines []models.StockLine) ([]models.FailedStockLine, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -222,44 +350,129 @@ func (r *WarehouseProductRepo) UpdateWPBatch(ctx context.Context, inputs []model
 		}
 	}()
 
-	for _, input := range inputs {
-		updateBuilder := squirrel.Update("warehouse_product").Where(squirrel.Eq{"id": input.ID}).RunWith(tx).PlaceholderFormat(squirrel.Dollar)
-		if input.WarehouseID != nil {
-			updateBuilder = updateBuilder.Set("warehouse_id", *input.WarehouseID)
-		}
-		if input.ProductID != nil {
-			updateBuilder = updateBuilder.Set("product_id", *input.ProductID)
+	failed, err := releaseStockTx(ctx, tx, lines)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return nil, fmt.Errorf("failed to rollback transaction: %w", err)
 		}
-		if input.Quantity != nil {
-			updateBuilder = updateBuilder.Set("quantity", *input.Quantity)
+		return failed, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil, nil
+}
+
+// AdjustWP changes quantity of every line by its Quantity in one transaction and records the reason
+// of the adjustment. Without override lines that would leave quantity below reserved_quantity fail
+// with ReasonBelowReserved; with override quantity only has to stay non-negative.
+func (r *WarehouseProductRepo) AdjustWP(ctx context.Context, adjustments []models.StockAdjustment, override bool) ([]models.FailedStockLine, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				fmt.Printf("Rollback error: %v\n", rollbackErr)
+			}
 		}
-		if input.ReservedQuantity != nil {
-			updateBuilder = updateBuilder.Set("reserved_quantity", *input.ReservedQuantity)
+	}()
+
+	lines := make([]models.StockLine, len(adjustments))
+	for i, adjustment := range adjustments {
+		lines[i] = adjustment.StockLine
+	}
+
+	failed, err := resolveStockLinesTx(ctx, tx, lines)
+	if err != nil {
+		return nil, err
+	}
+
+	floor := "reserved_quantity"
+	if override {
+		floor = "0"
+	}
+
+	// Lines are adjusted one by one in the lock order, each with its own reason
+	for _, i := range lockOrder(lines) {
+		if lines[i].ProductID == 0 {
+			continue
 		}
 
-		query, args, err := updateBuilder.ToSql()
+		var lineFailed []models.FailedStockLine
+		lineFailed, err = updateStockLinesTx(ctx, tx, lines[i:i+1], false, models.ReasonBelowReserved, models.MovementAdjust,
+			func(line models.StockLine) stockUpdate {
+				return stockUpdate{
+					query: squirrel.Update("warehouse_product").
+						Set("quantity", squirrel.Expr("quantity + ?", line.Quantity)).
+						Where(fmt.Sprintf("quantity + ? >= %s", floor), line.Quantity),
+					quantity: line.Quantity,
+					reason:   string(adjustments[i].Reason),
+				}
+			})
 		if err != nil {
-			return err
+			return nil, err
+		}
+		for _, line := range lineFailed {
+			line.Line = i
+			failed = append(failed, line)
 		}
+	}
 
-		_, err = tx.ExecContext(ctx, query, args...)
-		if err != nil {
-			return fmt.Errorf("failed to update warehouse product: %v", err)
+	if len(failed) > 0 {
+		if err = tx.Rollback(); err != nil {
+			return nil, fmt.Errorf("failed to rollback transaction: %w", err)
+		}
+		return failed, nil
+	}
+
+	var raised []models.StockLine
+	for _, line := range lines {
+		if line.Quantity > 0 {
+			raised = append(raised, line)
 		}
 	}
+	if err = fillBackordersTx(ctx, tx, raised); err != nil {
+		return nil, err
+	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return nil
+	return nil, nil
 }
 
+// DeleteWP deletes warehouse_product rows matching every non-empty field of the input.
+// Rows with reserved or in-transit stock can't be deleted, an empty input deletes nothing
 func (r *WarehouseProductRepo) DeleteWP(ctx context.Context, input models.DeleteWarehouseProductInput) error {
+	conditions := squirrel.And{}
+	if len(input.IDs) > 0 {
+		conditions = append(conditions, squirrel.Eq{"id": input.IDs})
+	}
+	if len(input.WarehouseID) > 0 {
+		conditions = append(conditions, squirrel.Eq{"warehouse_id": input.WarehouseID})
+	}
+	if len(input.ProductID) > 0 {
+		conditions = append(conditions, squirrel.Eq{"product_id": input.ProductID})
+	}
+	if len(conditions) == 0 {
+		return errors.New("empty warehouse product delete filter")
+	}
+
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -271,31 +484,527 @@ func (r *WarehouseProductRepo) DeleteWP(ctx context.Context, input models.Delete
 		}
 	}()
 
-	deleteQuery := squirrel.Delete("warehouse_product").RunWith(tx).PlaceholderFormat(squirrel.Dollar)
-	if len(input.IDs) > 0 {
-		deleteQuery = deleteQuery.Where(squirrel.Eq{"id": input.IDs})
+	lockQuery, lockArgs, err := squirrel.Select("id", "reserved_quantity", "in_transit_quantity").From("warehouse_product").
+		Where(conditions).OrderBy("id").Suffix("FOR UPDATE").PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return err
 	}
-	if len(input.WarehouseID) > 0 {
-		deleteQuery = deleteQuery.Where(squirrel.Eq{"warehouse_id": input.WarehouseID})
+
+	lockRows, err := tx.QueryContext(ctx, lockQuery, lockArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to lock warehouse products: %w", err)
 	}
-	if len(input.ProductID) > 0 {
-		deleteQuery = deleteQuery.Where(squirrel.Eq{"product_id": input.ProductID})
+	defer lockRows.Close()
+
+	var busy []int
+	for lockRows.Next() {
+		var id, reserved, inTransit int
+		if err = lockRows.Scan(&id, &reserved, &inTransit); err != nil {
+			return fmt.Errorf("failed to scan warehouse products: %w", err)
+		}
+		if reserved > 0 || inTransit > 0 {
+			busy = append(busy, id)
+		}
 	}
+	if err = lockRows.Err(); err != nil {
+		return err
+	}
+	lockRows.Close()
+	if len(busy) > 0 {
+		err = fmt.Errorf("warehouse products %v have reserved or in-transit stock: %w", busy, ErrConflict)
+		return err
+	}
+
+	deleteQuery := squirrel.Delete("warehouse_product").Where(conditions).RunWith(tx).PlaceholderFormat(squirrel.Dollar)
+	deleteQuery = deleteQuery.Suffix("RETURNING warehouse_id, product_id, quantity, reserved_quantity, in_transit_quantity")
 
 	query, args, err := deleteQuery.ToSql()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, query, args...)
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to delete warehouse product: %v", err)
+		return fmt.Errorf("failed to delete warehouse product: %w", err)
+	}
+	defer rows.Close()
+
+	var deleted []models.WarehouseProduct
+	for rows.Next() {
+		var wp models.WarehouseProduct
+		if err = rows.Scan(&wp.WarehouseID, &wp.ProductID, &wp.Quantity, &wp.ReservedQuantity, &wp.InTransitQuantity); err != nil {
+			return fmt.Errorf("failed to scan deleted warehouse products: %w", err)
+		}
+		deleted = append(deleted, wp)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if len(deleted) == 0 {
+		err = fmt.Errorf("no warehouse products to delete: %w", ErrNotFound)
+		return err
+	}
+
+	for _, wp := range deleted {
+		for _, movement := range adjustMovements(wp, models.WarehouseProduct{WarehouseID: wp.WarehouseID, ProductID: wp.ProductID}) {
+			err = recordStockMovementTx(ctx, tx, movement)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
+
+// updateWPTx overwrites the given fields of a warehouse_product row and records the change as an adjust movement
+func updateWPTx(ctx context.Context, tx *sql.Tx, input *models.UpdateWarehouseProductInput) error {
+	var old models.WarehouseProduct
+	err := tx.QueryRowContext(ctx, `SELECT warehouse_id, product_id, quantity, reserved_quantity, in_transit_quantity
+		FROM warehouse_product WHERE id = $1 FOR UPDATE`, input.ID).
+		Scan(&old.WarehouseID, &old.ProductID, &old.Quantity, &old.ReservedQuantity, &old.InTransitQuantity)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no warehouse product with ID: %d: %w", input.ID, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock warehouse product: %w", err)
+	}
+
+	updateBuilder := squirrel.Update("warehouse_product").Where(squirrel.Eq{"id": input.ID}).PlaceholderFormat(squirrel.Dollar)
+	if input.WarehouseID != nil {
+		updateBuilder = updateBuilder.Set("warehouse_id", *input.WarehouseID)
+	}
+	if input.ProductID != nil {
+		updateBuilder = updateBuilder.Set("product_id", *input.ProductID)
+	}
+	if input.Quantity != nil {
+		updateBuilder = updateBuilder.Set("quantity", *input.Quantity)
+	}
+	if input.ReservedQuantity != nil {
+		updateBuilder = updateBuilder.Set("reserved_quantity", *input.ReservedQuantity)
+	}
+	if input.MinLevel != nil {
+		updateBuilder = updateBuilder.Set("min_level", *input.MinLevel)
+	}
+	if input.ReorderPoint != nil {
+		updateBuilder = updateBuilder.Set("reorder_point", *input.ReorderPoint)
+	}
+	if input.SafetyStock != nil {
+		updateBuilder = updateBuilder.Set("safety_stock", *input.SafetyStock)
+	} else if input.ResetSafetyStock {
+		updateBuilder = updateBuilder.Set("safety_stock", nil)
+	}
+	updateBuilder = updateBuilder.Suffix("RETURNING warehouse_id, product_id, quantity, reserved_quantity, in_transit_quantity")
+
+	query, args, err := updateBuilder.ToSql()
+	if err != nil {
+		return err
+	}
+
+	var wp models.WarehouseProduct
+	err = tx.QueryRowContext(ctx, query, args...).
+		Scan(&wp.WarehouseID, &wp.ProductID, &wp.Quantity, &wp.ReservedQuantity, &wp.InTransitQuantity)
+	if err != nil {
+		return fmt.Errorf("failed to update warehouse product: %w", err)
+	}
+	if (input.Quantity != nil || input.ReservedQuantity != nil) && wp.ReservedQuantity > wp.Quantity {
+		return fmt.Errorf("reserved quantity %d of warehouse product %d exceeds quantity %d: %w",
+			wp.ReservedQuantity, input.ID, wp.Quantity, ErrInsufficientStock)
+	}
+
+	for _, movement := range adjustMovements(old, wp) {
+		if err := recordStockMovementTx(ctx, tx, movement); err != nil {
+			return err
+		}
+	}
+
+	// A higher quantity or a lower safety stock can make stock reservable for pending backorders
+	return fillProductBackordersTx(ctx, tx, wp.WarehouseID, wp.ProductID)
+}
+
+// reservableExpr is the quantity of the warehouse_product row given by table that reservations can take:
+// quantity - reserved_quantity - safety stock, where the safety stock of the row falls back to the warehouse default
+func reservableExpr(table string) string {
+	return fmt.Sprintf("%[1]s.quantity - %[1]s.reserved_quantity - "+
+		"COALESCE(%[1]s.safety_stock, (SELECT safety_stock FROM warehouses WHERE id = %[1]s.warehouse_id), 0)", table)
+}
+
+// reserveStockTx increases reserved_quantity of every line with a conditional update,
+// so concurrent transactions can never reserve more than the warehouse has beyond its safety stock.
+// With checkAvailability lines in blocked warehouses fail with ReasonWarehouseUnavailable.
+func reserveStockTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine, checkAvailability bool) ([]models.FailedStockLine, error) {
+	return updateStockLinesTx(ctx, tx, lines, checkAvailability, models.ReasonInsufficientStock, models.MovementReserve,
+		func(line models.StockLine) stockUpdate {
+			return stockUpdate{
+				query: squirrel.Update("warehouse_product").
+					Set("reserved_quantity", squirrel.Expr("reserved_quantity + ?", line.Quantity)).
+					Where(reservableExpr("warehouse_product")+" >= ?", line.Quantity),
+				reserved: line.Quantity,
+			}
+		})
+}
+
+// releaseStockTx decreases reserved_quantity of every line, failing lines that have less reserved than requested.
+// The released stock fills pending backorders.
+func releaseStockTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine) ([]models.FailedStockLine, error) {
+	failed, err := updateStockLinesTx(ctx, tx, lines, false, models.ReasonInsufficientReserve, models.MovementRelease,
+		func(line models.StockLine) stockUpdate {
+			return stockUpdate{
+				query: squirrel.Update("warehouse_product").
+					Set("reserved_quantity", squirrel.Expr("reserved_quantity - ?", line.Quantity)).
+					Where("reserved_quantity >= ?", line.Quantity),
+				reserved: -line.Quantity,
+			}
+		})
+	if err != nil || len(failed) > 0 {
+		return failed, err
+	}
+
+	return nil, fillBackordersTx(ctx, tx, lines)
+}
+
+// insertWPQuery builds the insert of a warehouse_product row
+func insertWPQuery(wp models.WarehouseProduct) squirrel.InsertBuilder {
+	return squirrel.Insert("warehouse_product").
+		Columns("warehouse_id", "product_id", "quantity", "reserved_quantity", "min_level", "reorder_point", "safety_stock").
+		Values(wp.WarehouseID, wp.ProductID, wp.Quantity, wp.ReservedQuantity, wp.MinLevel, wp.ReorderPoint, wp.SafetyStock).
+		PlaceholderFormat(squirrel.Dollar)
+}
+
+// receiveStockTx adds quantities of the lines to the stock, creating missing warehouse_product rows,
+// and fills pending backorders. Lines with unknown product codes are returned as failed.
+func receiveStockTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine) ([]models.FailedStockLine, error) {
+	failed, err := resolveStockLinesTx(ctx, tx, lines)
+	if err != nil || len(failed) > 0 {
+		return failed, err
+	}
+
+	for _, i := range lockOrder(lines) {
+		line := lines[i]
+
+		insertQuery := insertWPQuery(models.WarehouseProduct{WarehouseID: line.WarehouseID, ProductID: line.ProductID, Quantity: line.Quantity}).
+			Suffix("ON CONFLICT (warehouse_id, product_id) DO UPDATE SET quantity = warehouse_product.quantity + EXCLUDED.quantity")
+
+		query, args, err := insertQuery.ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive warehouse product: %w", err)
+		}
+
+		err = recordStockMovementTx(ctx, tx, models.StockMovement{
+			WarehouseID:   line.WarehouseID,
+			ProductID:     line.ProductID,
+			Type:          models.MovementReceive,
+			QuantityDelta: line.Quantity,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fillBackordersTx(ctx, tx, lines)
+}
+
+// shipStockTx removes shipped quantities of the lines from both quantity and reserved_quantity.
+func shipStockTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine) ([]models.FailedStockLine, error) {
+	return updateStockLinesTx(ctx, tx, lines, false, models.ReasonInsufficientReserve, models.MovementShip,
+		func(line models.StockLine) stockUpdate {
+			return stockUpdate{
+				query: squirrel.Update("warehouse_product").
+					Set("quantity", squirrel.Expr("quantity - ?", line.Quantity)).
+					Set("reserved_quantity", squirrel.Expr("reserved_quantity - ?", line.Quantity)).
+					Where("reserved_quantity >= ?", line.Quantity),
+				quantity: -line.Quantity,
+				reserved: -line.Quantity,
+			}
+		})
+}
+
+// stockUpdate is a conditional update of a warehouse_product row and the changes of its quantities
+type stockUpdate struct {
+	query     squirrel.UpdateBuilder
+	quantity  int
+	reserved  int
+	inTransit int
+	reason    string
+}
+
+// updateStockLinesTx resolves product codes, then applies the update built by build to every line
+// in a stable (warehouse_id, product_id) order to avoid deadlocks between concurrent transactions.
+// Every applied update is recorded as a stock movement of the given type.
+// Lines whose update affected no rows are returned as failed with the given reason.
+func updateStockLinesTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine, checkAvailability bool, reason string,
+	movementType models.MovementType, build func(line models.StockLine) stockUpdate) ([]models.FailedStockLine, error) {
+	failed, err := checkStockLinesTx(ctx, tx, lines, checkAvailability)
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[int]bool, len(failed))
+	for _, line := range failed {
+		skip[line.Line] = true
+	}
+
+	for _, i := range lockOrder(lines) {
+		line := lines[i]
+		if skip[i] {
+			continue
+		}
+
+		update := build(line)
+		updateQuery := update.query.
+			Where(squirrel.Eq{"warehouse_id": line.WarehouseID, "product_id": line.ProductID}).
+			PlaceholderFormat(squirrel.Dollar)
+
+		query, args, err := updateQuery.ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update warehouse product: %w", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if affected > 0 {
+			err = recordStockMovementTx(ctx, tx, models.StockMovement{
+				WarehouseID:    line.WarehouseID,
+				ProductID:      line.ProductID,
+				Type:           movementType,
+				QuantityDelta:  update.quantity,
+				ReservedDelta:  update.reserved,
+				InTransitDelta: update.inTransit,
+				Reason:         update.reason,
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var exists bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM warehouse_product WHERE warehouse_id = $1 AND product_id = $2)",
+			line.WarehouseID, line.ProductID).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check warehouse product: %w", err)
+		}
+		if exists {
+			failed = append(failed, models.FailedStockLine{StockLine: line, Line: i, Reason: reason})
+		} else {
+			failed = append(failed, models.FailedStockLine{StockLine: line, Line: i, Reason: models.ReasonNotFound})
+		}
+	}
+
+	return failed, nil
+}
+
+// checkStockLinesTx resolves product codes of the lines and, with checkAvailability,
+// fails lines in blocked warehouses. The warehouses are share-locked so that
+// a concurrent block waits for the stock operation to finish.
+func checkStockLinesTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine, checkAvailability bool) ([]models.FailedStockLine, error) {
+	failed, err := resolveStockLinesTx(ctx, tx, lines)
+	if err != nil || !checkAvailability {
+		return failed, err
+	}
+
+	warehouseIDs := make([]int, 0, len(lines))
+	for _, line := range lines {
+		warehouseIDs = append(warehouseIDs, line.WarehouseID)
+	}
+
+	query, args, err := squirrel.Select("id", "availability").From("warehouses").
+		Where(squirrel.Eq{"id": warehouseIDs}).
+		OrderBy("id").
+		Suffix("FOR SHARE").
+		PlaceholderFormat(squirrel.Dollar).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check warehouses availability: %w", err)
+	}
+	defer rows.Close()
+
+	blocked := make(map[int]bool, len(warehouseIDs))
+	for rows.Next() {
+		var id int
+		var availability bool
+		if err := rows.Scan(&id, &availability); err != nil {
+			return nil, fmt.Errorf("failed to scan warehouses: %w", err)
+		}
+		blocked[id] = !availability
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, line := range lines {
+		if line.ProductID != 0 && blocked[line.WarehouseID] {
+			failed = append(failed, models.FailedStockLine{StockLine: line, Line: i, Reason: models.ReasonWarehouseUnavailable})
+		}
+	}
+
+	return failed, nil
+}
+
+// resolveStockLinesTx fills ProductID of lines given by barcode or product code, lines given
+// by barcode also get the product code. Lines with unknown codes are returned as failed and keep zero ProductID.
+func resolveStockLinesTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine) ([]models.FailedStockLine, error) {
+	var failed []models.FailedStockLine
+
+	codes := make([]string, 0, len(lines))
+	barcodes := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line.ProductID != 0 {
+			continue
+		}
+		if line.Barcode != "" {
+			barcodes = append(barcodes, line.Barcode)
+		} else {
+			codes = append(codes, line.Code)
+		}
+	}
+	if len(codes) == 0 && len(barcodes) == 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, code, '' FROM products WHERE code = ANY($1)
+		UNION ALL
+		SELECT p.id, p.code, b.barcode FROM product_barcodes b JOIN products p ON p.id = b.product_id
+		WHERE b.barcode = ANY($2)`, pq.Array(codes), pq.Array(barcodes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get products by code: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]int, len(codes))
+	byBarcode := make(map[string]models.StockLine, len(barcodes))
+	for rows.Next() {
+		var id int
+		var code, barcode string
+		if err := rows.Scan(&id, &code, &barcode); err != nil {
+			return nil, fmt.Errorf("failed to scan products: %w", err)
+		}
+		if barcode != "" {
+			byBarcode[barcode] = models.StockLine{ProductID: id, Code: code}
+		} else {
+			ids[code] = id
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range lines {
+		if lines[i].ProductID != 0 {
+			continue
+		}
+		if lines[i].Barcode != "" {
+			if product, ok := byBarcode[lines[i].Barcode]; ok {
+				lines[i].ProductID, lines[i].Code = product.ProductID, product.Code
+			} else {
+				failed = append(failed, models.FailedStockLine{StockLine: lines[i], Line: i, Reason: models.ReasonNotFound})
+			}
+			continue
+		}
+		if id, ok := ids[lines[i].Code]; ok {
+			lines[i].ProductID = id
+		} else {
+			failed = append(failed, models.FailedStockLine{StockLine: lines[i], Line: i, Reason: models.ReasonNotFound})
+		}
+	}
+
+	return failed, nil
+}
+
+// reservePartialTx reserves as much of every line as is available, locking the stock rows
+// in a stable order, and reports the reserved quantity of each line.
+func reservePartialTx(ctx context.Context, tx *sql.Tx, lines []models.StockLine, checkAvailability bool) ([]models.StockLineResult, error) {
+	results := make([]models.StockLineResult, len(lines))
+	for i, line := range lines {
+		results[i] = models.StockLineResult{WarehouseID: line.WarehouseID, Code: line.Code, Barcode: line.Barcode, Requested: line.Quantity}
+	}
+
+	failed, err := checkStockLinesTx(ctx, tx, lines, checkAvailability)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range failed {
+		results[line.Line].Reason = line.Reason
+	}
+
+	for _, i := range lockOrder(lines) {
+		line := lines[i]
+		results[i].ProductID, results[i].Code = line.ProductID, line.Code
+		if results[i].Reason != "" {
+			continue
+		}
+
+		var available int
+		err = tx.QueryRowContext(ctx, `SELECT `+reservableExpr("warehouse_product")+` FROM warehouse_product
+			WHERE warehouse_id = $1 AND product_id = $2 FOR UPDATE`, line.WarehouseID, line.ProductID).Scan(&available)
+		if errors.Is(err, sql.ErrNoRows) {
+			results[i].Reason = models.ReasonNotFound
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock warehouse product: %w", err)
+		}
+
+		reserved := min(line.Quantity, max(available, 0))
+		if reserved < line.Quantity {
+			results[i].Reason = models.ReasonInsufficientStock
+		}
+		if reserved == 0 {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE warehouse_product SET reserved_quantity = reserved_quantity + $1
+			WHERE warehouse_id = $2 AND product_id = $3`, reserved, line.WarehouseID, line.ProductID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update warehouse product: %w", err)
+		}
+		err = recordStockMovementTx(ctx, tx, models.StockMovement{
+			WarehouseID:   line.WarehouseID,
+			ProductID:     line.ProductID,
+			Type:          models.MovementReserve,
+			ReservedDelta: reserved,
+		})
+		if err != nil {
+			return nil, err
+		}
+		results[i].Reserved = reserved
+	}
+
+	return results, nil
+}
+
+// lockOrder returns indices of lines sorted by (warehouse_id, product_id),
+// the order in which stock rows are locked to avoid deadlocks between concurrent transactions.
+func lockOrder(lines []models.StockLine) []int {
+	order := make([]int, len(lines))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if lines[order[a]].WarehouseID != lines[order[b]].WarehouseID {
+			return lines[order[a]].WarehouseID < lines[order[b]].WarehouseID
+		}
+		return lines[order[a]].ProductID < lines[order[b]].ProductID
+	})
+	return order
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"LamodaTest/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+)
+
+// testDSNEnv names the variable with the URL of a PostgreSQL database for tests, the tests are skipped without it
+const testDSNEnv = "TEST_DATABASE_URL"
+
+// testDB migrates a new schema of the test database and returns a connection to it. The schema is dropped
+// after the test, so the rows written by the test, including the append-only stock_movements, don't pile up
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	// Extensions already installed in public stay visible through the search path
+	schemaURL, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("%s must be a URL: %v", testDSNEnv, err)
+	}
+	query := schemaURL.Query()
+	query.Set("search_path", schema+",public")
+	schemaURL.RawQuery = query.Encode()
+
+	m, err := migrate.New("file://../../migrations", schemaURL.String())
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatalf("migrate up: %v", err)
+	}
+	sourceErr, dbErr := m.Close()
+	if sourceErr != nil || dbErr != nil {
+		t.Fatalf("migrate close: %v, %v", sourceErr, dbErr)
+	}
+
+	db, err := sql.Open("postgres", schemaURL.String())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	db.SetMaxOpenConns(20)
+	// Registered after the schema cleanup, so it runs first and no connection holds the schema when it's dropped
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// seedStock creates a warehouse and a product with quantity in stock
+func seedStock(t *testing.T, db *sql.DB, quantity int) (int, int) {
+	t.Helper()
+	ctx := context.Background()
+
+	var warehouseID, productID int
+	if err := db.QueryRowContext(ctx, "INSERT INTO warehouses (name, availability) VALUES ('test', true) RETURNING id").
+		Scan(&warehouseID); err != nil {
+		t.Fatalf("insert warehouse: %v", err)
+	}
+	if err := db.QueryRowContext(ctx, "INSERT INTO products (name, size, code) VALUES ('test', 'M', 'test') RETURNING id").
+		Scan(&productID); err != nil {
+		t.Fatalf("insert product: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO warehouse_product (warehouse_id, product_id, quantity) VALUES ($1, $2, $3)",
+		warehouseID, productID, quantity); err != nil {
+		t.Fatalf("insert warehouse_product: %v", err)
+	}
+
+	return warehouseID, productID
+}
+
+// TestConcurrentReserveRelease hammers one warehouse_product row with reserves, releases and reservations
+// and checks that the reserve never leaves [0, quantity] and matches the successful operations
+func TestConcurrentReserveRelease(t *testing.T) {
+	db := testDB(t)
+	const quantity = 100
+	warehouseID, productID := seedStock(t, db, quantity)
+	wp := NewWarehouseProductRepo(db, models.BlockPolicyRejectNew)
+	reservations := NewReservationRepo(db, models.BlockPolicyRejectNew)
+
+	const workers = 16
+	const iterations = 50
+	var reserved atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			ctx := context.Background()
+			random := rand.New(rand.NewSource(seed))
+			// Workers release only what they reserved themselves, so releases must always succeed
+			var held []int
+			for i := 0; i < iterations; i++ {
+				line := models.StockLine{WarehouseID: warehouseID, ProductID: productID, Quantity: random.Intn(10) + 1}
+				switch random.Intn(3) {
+				case 0:
+					failed, err := wp.ReserveWP(ctx, []models.StockLine{line})
+					if err != nil {
+						errs <- fmt.Errorf("reserve: %w", err)
+						return
+					}
+					if len(failed) == 0 {
+						reserved.Add(int64(line.Quantity))
+						held = append(held, line.Quantity)
+					}
+				case 1:
+					if len(held) == 0 {
+						continue
+					}
+					line.Quantity, held = held[len(held)-1], held[:len(held)-1]
+					failed, err := wp.ReleaseWP(ctx, []models.StockLine{line})
+					if err != nil {
+						errs <- fmt.Errorf("release: %w", err)
+						return
+					}
+					if len(failed) > 0 {
+						errs <- fmt.Errorf("release of %d failed: %s", line.Quantity, failed[0].Reason)
+						return
+					}
+					reserved.Add(-int64(line.Quantity))
+				case 2:
+					id, _, err := reservations.CreateReservation(ctx, models.CreateReservationInput{
+						TTL:   time.Hour,
+						Mode:  models.ReserveAllOrNothing,
+						Lines: []models.StockLine{line},
+					})
+					if err != nil {
+						errs <- fmt.Errorf("create reservation: %w", err)
+						return
+					}
+					if id == 0 {
+						continue
+					}
+					reserved.Add(int64(line.Quantity))
+					if random.Intn(2) == 0 {
+						continue
+					}
+					if err := reservations.ReleaseReservation(ctx, id); err != nil {
+						errs <- fmt.Errorf("release reservation: %w", err)
+						return
+					}
+					reserved.Add(-int64(line.Quantity))
+				}
+			}
+		}(int64(w))
+	}
+
+	// The bounds are also checked while the workers run, not only at the end
+	done := make(chan struct{})
+	sampled := make(chan error, 1)
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			var q, r int
+			if err := db.QueryRow("SELECT quantity, reserved_quantity FROM warehouse_product WHERE warehouse_id = $1 AND product_id = $2",
+				warehouseID, productID).Scan(&q, &r); err != nil {
+				sampled <- fmt.Errorf("sample warehouse_product: %w", err)
+				return
+			}
+			if r < 0 || r > q {
+				sampled <- fmt.Errorf("reserved_quantity = %d out of [0, %d] while running", r, q)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	if err := <-sampled; err != nil {
+		t.Error(err)
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var finalQuantity, finalReserved int
+	if err := db.QueryRow("SELECT quantity, reserved_quantity FROM warehouse_product WHERE warehouse_id = $1 AND product_id = $2",
+		warehouseID, productID).Scan(&finalQuantity, &finalReserved); err != nil {
+		t.Fatalf("select warehouse_product: %v", err)
+	}
+	if finalQuantity != quantity {
+		t.Errorf("quantity = %d, want %d", finalQuantity, quantity)
+	}
+	if finalReserved < 0 || finalReserved > finalQuantity {
+		t.Errorf("reserved_quantity = %d, want within [0, %d]", finalReserved, finalQuantity)
+	}
+	if int64(finalReserved) != reserved.Load() {
+		t.Errorf("reserved_quantity = %d, successful reserves minus releases = %d", finalReserved, reserved.Load())
+	}
+}
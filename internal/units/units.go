@@ -0,0 +1,34 @@
+package units
+
+import (
+	"errors"
+	"math"
+	"math/big"
+)
+
+// BaseUnit is the unit of measure of products that don't set their own
+const BaseUnit = "pcs"
+
+var (
+	ErrInvalidQuantity    = errors.New("invalid quantity")
+	ErrFractionalQuantity = errors.New("quantity is not a whole number of base units")
+)
+
+// ToBase converts a decimal quantity of packs of packSize base units into base units.
+// Results that aren't whole or don't fit into int32, like the quantity columns, are rejected
+func ToBase(packs string, packSize int) (int, error) {
+	quantity, ok := new(big.Rat).SetString(packs)
+	if !ok || packSize <= 0 {
+		return 0, ErrInvalidQuantity
+	}
+
+	quantity.Mul(quantity, new(big.Rat).SetInt64(int64(packSize)))
+	if !quantity.IsInt() {
+		return 0, ErrFractionalQuantity
+	}
+	if !quantity.Num().IsInt64() || quantity.Num().Int64() > math.MaxInt32 || quantity.Num().Int64() < math.MinInt32 {
+		return 0, ErrInvalidQuantity
+	}
+
+	return int(quantity.Num().Int64()), nil
+}
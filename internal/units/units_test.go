@@ -0,0 +1,50 @@
+package units
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestToBase(t *testing.T) {
+	tests := []struct {
+		name     string
+		packs    string
+		packSize int
+		want     int
+		wantErr  error
+	}{
+		{"whole packs", "3", 12, 36, nil},
+		{"base unit", "7", 1, 7, nil},
+		{"zero", "0", 12, 0, nil},
+		{"negative", "-2", 6, -12, nil},
+		{"decimal", "1.5", 12, 18, nil},
+		{"trailing zeros", "2.50", 4, 10, nil},
+		{"fraction", "3/4", 8, 6, nil},
+		{"exponent", "1e2", 3, 300, nil},
+		{"fractional result", "0.5", 3, 0, ErrFractionalQuantity},
+		{"fractional base unit", "1.25", 1, 0, ErrFractionalQuantity},
+		{"tiny fraction", "0.0000001", 1000, 0, ErrFractionalQuantity},
+		{"max int32", "2147483647", 1, 2147483647, nil},
+		{"min int32", "-2147483648", 1, -2147483648, nil},
+		{"int32 overflow", "2147483648", 1, 0, ErrInvalidQuantity},
+		{"int32 overflow by pack size", "1073741824", 2, 0, ErrInvalidQuantity},
+		{"int32 underflow", "-2147483649", 1, 0, ErrInvalidQuantity},
+		{"int64 overflow", "100000000000000000000", 1, 0, ErrInvalidQuantity},
+		{"empty", "", 12, 0, ErrInvalidQuantity},
+		{"not a number", "two", 12, 0, ErrInvalidQuantity},
+		{"zero pack size", "1", 0, 0, ErrInvalidQuantity},
+		{"negative pack size", "1", -6, 0, ErrInvalidQuantity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToBase(tt.packs, tt.packSize)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ToBase(%q, %d) error = %v, want %v", tt.packs, tt.packSize, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ToBase(%q, %d) = %d, want %d", tt.packs, tt.packSize, got, tt.want)
+			}
+		})
+	}
+}
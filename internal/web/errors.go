@@ -0,0 +1,95 @@
+package web
+
+import (
+	"LamodaTest/internal/storage"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Machine-readable codes of error responses. Failed stock lines use their reason as the code
+const (
+	codeNotFound             = "not_found"
+	codeConflict             = "conflict"
+	codeInsufficientStock    = "insufficient_stock"
+	codeWarehouseUnavailable = "warehouse_unavailable"
+	codeInternal             = "internal_error"
+)
+
+// errorResponse is the body of every error response
+type errorResponse struct {
+	Error     string      `json:"error"`
+	Code      string      `json:"code"`
+	RequestID string      `json:"request_id"`
+	Failed    interface{} `json:"failed,omitempty"`
+}
+
+func badRequest(message string) error {
+	return echo.NewHTTPError(http.StatusBadRequest, message)
+}
+
+func notFound(message string) error {
+	return echo.NewHTTPError(http.StatusNotFound, message)
+}
+
+// HTTPErrorHandler writes errors returned by handlers: storage errors are mapped to 400, 404, 409 and 422,
+// echo errors keep their status and everything else is 500 with the cause logged under the request ID
+func (s *Server) HTTPErrorHandler(err error, c echo.Context) {
+	requestID, _ := c.Get("requestID").(string)
+	response := errorResponse{Error: err.Error(), Code: codeInternal, RequestID: requestID}
+	status := http.StatusInternalServerError
+
+	var httpErr *echo.HTTPError
+	var linesErr *storage.StockLinesError
+	switch {
+	case errors.As(err, &httpErr):
+		status = httpErr.Code
+		response.Error = fmt.Sprint(httpErr.Message)
+		response.Code = httpErrorCode(status)
+	case errors.Is(err, storage.ErrInvalidFilter), errors.Is(err, storage.ErrInvalidQuantity):
+		status, response.Code = http.StatusBadRequest, httpErrorCode(http.StatusBadRequest)
+	case errors.Is(err, storage.ErrNotFound):
+		status, response.Code = http.StatusNotFound, codeNotFound
+	case errors.Is(err, storage.ErrConflict):
+		status, response.Code = http.StatusConflict, codeConflict
+	case errors.Is(err, storage.ErrWarehouseUnavailable):
+		status, response.Code = http.StatusConflict, codeWarehouseUnavailable
+	case errors.Is(err, storage.ErrInsufficientStock):
+		status, response.Code = http.StatusUnprocessableEntity, codeInsufficientStock
+	}
+	if errors.As(err, &linesErr) {
+		response.Code = linesErr.Reason
+		response.Failed = linesErr.Failed
+	}
+	// The cause of a server error is only logged, clients get a generic message without SQL or driver details
+	if status >= http.StatusInternalServerError {
+		s.logger.Error("Server", slog.String("requestID", requestID), slog.String("error", err.Error()))
+		if httpErr == nil {
+			response.Error = http.StatusText(status)
+		}
+	}
+
+	if c.Response().Committed {
+		return
+	}
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, response)
+	}
+	if err != nil {
+		s.logger.Error("Server", slog.String("requestID", requestID),
+			slog.String("error", fmt.Sprintf("Unable to write error response: %v", err.Error())))
+	}
+}
+
+// httpErrorCode turns the status into a code like bad_request or method_not_allowed
+func httpErrorCode(status int) string {
+	if status >= http.StatusInternalServerError {
+		return codeInternal
+	}
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
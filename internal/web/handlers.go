@@ -1,50 +1,301 @@
 package web
 
 import (
+	"LamodaTest/internal/allocation"
+	"LamodaTest/internal/barcode"
 	"LamodaTest/internal/models"
+	"LamodaTest/internal/storage"
+	"LamodaTest/internal/units"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/labstack/echo"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// ReserveDTO with Backorder reserves what is available and queues the rest of every line as a backorder
 type ReserveDTO struct {
 	Reservations []Reserve `json:"reservations"`
+	OrderRef     string    `json:"order_ref"`
+	TTL          int       `json:"ttl"`
+	Mode         string    `json:"mode"`
+	Strategy     string    `json:"strategy"`
+	Backorder    bool      `json:"backorder"`
 }
 
+// Reserve without warehouse_id is allocated to warehouses by the strategy of the request.
+// The product is given by code or barcode, the quantity by quantity in base units or by pack and the number of packs
 type Reserve struct {
+	Code        string      `json:"code"`
+	Barcode     string      `json:"barcode"`
+	Quantity    int         `json:"quantity"`
+	Pack        string      `json:"pack"`
+	Packs       json.Number `json:"packs"`
+	WarehouseID int         `json:"warehouse_id"`
+}
+
+type ReleaseDTO struct {
+	Releases      []Release `json:"releases"`
+	ReservationID int       `json:"reservation_id"`
+}
+
+type Release struct {
+	Code        string      `json:"code"`
+	Barcode     string      `json:"barcode"`
+	Quantity    int         `json:"quantity"`
+	Pack        string      `json:"pack"`
+	Packs       json.Number `json:"packs"`
+	WarehouseID int         `json:"warehouse_id"`
+}
+
+// ShipDTO without lines ships everything left on the reservation
+type ShipDTO struct {
+	ReservationID int    `json:"reservation_id"`
+	Lines         []Ship `json:"lines"`
+}
+
+// Ship without warehouse_id is shipped from any warehouse of the reservation
+type Ship struct {
 	Code        string `json:"code"`
 	Quantity    int    `json:"quantity"`
 	WarehouseID int    `json:"warehouse_id"`
 }
 
-type ReleaseDTO struct {
-	Releases []Release `json:"releases"`
+// ReceiveDTO is a receipt document, Number makes repeated receipts idempotent
+type ReceiveDTO struct {
+	Number      string    `json:"number"`
+	WarehouseID int       `json:"warehouse_id"`
+	SupplierRef string    `json:"supplier_ref"`
+	Lines       []Receive `json:"lines"`
 }
 
-type Release struct {
+type Receive struct {
+	Code     string      `json:"code"`
+	Barcode  string      `json:"barcode"`
+	Quantity int         `json:"quantity"`
+	Pack     string      `json:"pack"`
+	Packs    json.Number `json:"packs"`
+}
+
+type TransferDTO struct {
+	SourceWarehouseID      int        `json:"source_warehouse_id"`
+	DestinationWarehouseID int        `json:"destination_warehouse_id"`
+	Lines                  []Transfer `json:"lines"`
+}
+
+type Transfer struct {
+	Code     string      `json:"code"`
+	Quantity int         `json:"quantity"`
+	Pack     string      `json:"pack"`
+	Packs    json.Number `json:"packs"`
+}
+
+// AdjustDTO changes stock by the quantities of the lines, negative quantities write stock off.
+// Override allows quantity to drop below reserved_quantity
+type AdjustDTO struct {
+	Lines    []Adjust `json:"lines"`
+	Override bool     `json:"override"`
+}
+
+type Adjust struct {
 	Code        string `json:"code"`
 	Quantity    int    `json:"quantity"`
 	WarehouseID int    `json:"warehouse_id"`
+	Reason      string `json:"reason"`
 }
 
-type WarehouseProductsDTO struct {
+type StocktakeDTO struct {
 	WarehouseID int `json:"warehouse_id"`
 }
 
+type StocktakeCountsDTO struct {
+	Counts []StocktakeCount `json:"counts"`
+}
+
+type StocktakeCount struct {
+	Code     string `json:"code"`
+	Quantity int    `json:"quantity"`
+	Reason   string `json:"reason"`
+}
+
+type ApplyStocktakeDTO struct {
+	Override bool `json:"override"`
+}
+
+type ThresholdsDTO struct {
+	Lines []Threshold `json:"lines"`
+}
+
+// Threshold with zero min_level and reorder_point disables low-stock alerts for the product
+type Threshold struct {
+	Code         string `json:"code"`
+	WarehouseID  int    `json:"warehouse_id"`
+	MinLevel     int    `json:"min_level"`
+	ReorderPoint int    `json:"reorder_point"`
+}
+
+// SafetyStockDTO sets the warehouse default when Default is given and overrides it for the products of the lines
+type SafetyStockDTO struct {
+	WarehouseID int           `json:"warehouse_id"`
+	Default     *int          `json:"default"`
+	Lines       []SafetyStock `json:"lines"`
+}
+
+// SafetyStock with null safety_stock makes the product use the warehouse default
+type SafetyStock struct {
+	Code        string `json:"code"`
+	SafetyStock *int   `json:"safety_stock"`
+}
+
 type BlockWarehouseDTO struct {
 	WarehouseID int `json:"warehouse_id"`
 }
 
+// WarehouseDTO without availability creates an available warehouse
+type WarehouseDTO struct {
+	Name         string `json:"name"`
+	Availability *bool  `json:"availability"`
+	Priority     int    `json:"priority"`
+	SafetyStock  int    `json:"safety_stock"`
+}
+
+// ProductDTO with style_id creates a variant of the style, size and color tell the variants apart.
+// Unit is the base unit of stock quantities, pcs by default
+type ProductDTO struct {
+	Name    string `json:"name"`
+	Size    string `json:"size"`
+	Code    string `json:"code"`
+	StyleID *int   `json:"style_id"`
+	Color   string `json:"color"`
+	Unit    string `json:"unit"`
+	// WarehouseID is only sent by clients of the removed POST /products stock listing
+	WarehouseID *int `json:"warehouse_id"`
+}
+
+// BarcodesDTO lists GTIN-8, GTIN-12, GTIN-13 or GTIN-14 barcodes of a product
+type BarcodesDTO struct {
+	Barcodes []string `json:"barcodes"`
+}
+
+// PackDTO defines a pack of a product holding quantity base units
+type PackDTO struct {
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+}
+
+type StyleDTO struct {
+	Article  string `json:"article"`
+	Name     string `json:"name"`
+	SizeGrid string `json:"size_grid"`
+}
+
+// StockDTO places a product given by product_id or code into a warehouse. Reserved quantity of a new stock line is zero
+type StockDTO struct {
+	WarehouseID  int    `json:"warehouse_id"`
+	ProductID    int    `json:"product_id"`
+	Code         string `json:"code"`
+	Quantity     int    `json:"quantity"`
+	MinLevel     int    `json:"min_level"`
+	ReorderPoint int    `json:"reorder_point"`
+	SafetyStock  *int   `json:"safety_stock"`
+}
+
+// pageResponse is a page of a list, next_cursor is passed as cursor to get the next page and is empty on the last page
+type pageResponse struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor"`
+}
+
+// Limits of list pages
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// Lengths of the VARCHAR columns of warehouses and products
+const (
+	maxWarehouseNameLength = 255
+	maxProductNameLength   = 255
+	maxProductSizeLength   = 50
+	maxProductCodeLength   = 50
+	maxProductColorLength  = 50
+	maxUnitLength          = 20
+	maxStyleArticleLength  = 50
+	maxStyleNameLength     = 255
+	maxStyleSizeGridLength = 50
+)
+
 func (s *Server) RegisterHandlers() {
 	app := s.app
 
 	apiGroup := app.Group("/api/v1")
-	apiGroup.POST("/reserve", s.ReserveProductHandler)
-	apiGroup.POST("/release", s.ReleaseProductHandler)
+	idempotency := s.middleware.Idempotency()
+	apiGroup.GET("/status", s.StatusHandler)
+	apiGroup.POST("/reserve", s.ReserveProductHandler, idempotency)
+	apiGroup.POST("/release", s.ReleaseProductHandler, idempotency)
+	apiGroup.GET("/reservations/:id", s.GetReservationHandler)
+	apiGroup.POST("/ship", s.ShipHandler, idempotency)
+	apiGroup.GET("/shipments/:id", s.GetShipmentHandler)
+	apiGroup.POST("/receive", s.ReceiveHandler)
+	apiGroup.GET("/receipts/:id", s.GetReceiptHandler)
+	apiGroup.POST("/transfers", s.CreateTransferHandler)
+	apiGroup.GET("/transfers/:id", s.GetTransferHandler)
+	apiGroup.POST("/transfers/:id/dispatch", s.DispatchTransferHandler)
+	apiGroup.POST("/transfers/:id/receive", s.ReceiveTransferHandler)
+	apiGroup.POST("/transfers/:id/cancel", s.CancelTransferHandler)
+	apiGroup.GET("/movements", s.GetMovementsHandler)
+	apiGroup.POST("/adjust", s.AdjustHandler, idempotency)
+	apiGroup.POST("/stocktakes", s.CreateStocktakeHandler)
+	apiGroup.GET("/stocktakes/:id", s.GetStocktakeHandler)
+	apiGroup.POST("/stocktakes/:id/counts", s.SubmitStocktakeCountsHandler)
+	apiGroup.GET("/stocktakes/:id/variance", s.GetStocktakeVarianceHandler)
+	apiGroup.POST("/stocktakes/:id/apply", s.ApplyStocktakeHandler)
+	apiGroup.POST("/stocktakes/:id/cancel", s.CancelStocktakeHandler)
 
-	apiGroup.POST("/products", s.GetWarehouseHandler)
+	apiGroup.GET("/warehouses", s.GetWarehousesHandler)
+	apiGroup.POST("/warehouses", s.CreateWarehouseHandler)
+	apiGroup.GET("/warehouses/:id", s.GetWarehouseByIDHandler)
+	apiGroup.PATCH("/warehouses/:id", s.UpdateWarehouseHandler)
+	apiGroup.DELETE("/warehouses/:id", s.DeleteWarehouseHandler)
+	apiGroup.POST("/thresholds", s.SetThresholdsHandler)
+	apiGroup.POST("/safety-stock", s.SetSafetyStockHandler)
+	apiGroup.GET("/warehouses/:id/low-stock", s.GetLowStockHandler)
+	apiGroup.GET("/alerts", s.GetStockAlertsHandler)
+	apiGroup.GET("/events", s.GetEventsHandler)
+	apiGroup.GET("/styles", s.GetStylesHandler)
+	apiGroup.POST("/styles", s.CreateStyleHandler)
+	apiGroup.GET("/styles/stock", s.GetStyleStockHandler)
+	apiGroup.GET("/styles/:id", s.GetStyleHandler)
+	apiGroup.PATCH("/styles/:id", s.UpdateStyleHandler)
+	apiGroup.DELETE("/styles/:id", s.DeleteStyleHandler)
+	apiGroup.GET("/warehouses/:id/products", s.GetWarehouseProductsHandler)
+	apiGroup.GET("/products", s.GetProductsHandler)
+	apiGroup.POST("/products", s.CreateProductHandler)
+	apiGroup.GET("/products/code/:code", s.GetProductByCodeHandler)
+	apiGroup.GET("/products/search", s.SearchProductsHandler)
+	apiGroup.GET("/products/:id", s.GetProductHandler)
+	apiGroup.PATCH("/products/:id", s.UpdateProductHandler)
+	apiGroup.DELETE("/products/:id", s.DeleteProductHandler)
+	apiGroup.GET("/products/:id/packs", s.GetProductPacksHandler)
+	apiGroup.POST("/products/:id/packs", s.SetProductPackHandler)
+	apiGroup.DELETE("/products/:id/packs/:name", s.DeleteProductPackHandler)
+	apiGroup.GET("/products/:id/barcodes", s.GetProductBarcodesHandler)
+	apiGroup.POST("/products/:id/barcodes", s.AddProductBarcodesHandler)
+	apiGroup.GET("/barcodes/:barcode", s.GetBarcodeHandler)
+	apiGroup.DELETE("/barcodes/:barcode", s.DeleteBarcodeHandler)
+	apiGroup.GET("/stocks/as-of", s.GetStockAsOfHandler)
+	apiGroup.GET("/stocks", s.GetStocksHandler)
+	apiGroup.POST("/stocks", s.CreateStockHandler)
+	apiGroup.DELETE("/stocks", s.DeleteStocksHandler)
+	apiGroup.GET("/stocks/:id", s.GetStockHandler)
+	apiGroup.PATCH("/stocks/:id", s.UpdateStockHandler)
+	apiGroup.DELETE("/stocks/:id", s.DeleteStockHandler)
 	apiGroup.POST("/block", s.BlockWarehouseHandler)
 	apiGroup.POST("/unblock", s.UnblockWarehouseHandler)
 
@@ -52,182 +303,1986 @@ func (s *Server) RegisterHandlers() {
 }
 
 func (s *Server) ReserveProductHandler(c echo.Context) error {
-	requestID := c.Get("requestID").(string)
 	var reserveData ReserveDTO
 	if err := c.Bind(&reserveData); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return badRequest("invalid request body")
 	}
 
 	if len(reserveData.Reservations) < 1 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Empty request"})
+		return badRequest("Empty request")
+	}
+
+	if reserveData.TTL < 0 {
+		return badRequest("ttl can't be negative")
+	}
+	ttl := s.reservationTTL
+	if reserveData.TTL > 0 {
+		ttl = time.Duration(reserveData.TTL) * time.Second
+	}
+
+	mode := models.ReserveMode(reserveData.Mode)
+	if reserveData.Backorder {
+		if mode == models.ReserveAllOrNothing {
+			return badRequest("backorder can't be used with all_or_nothing mode")
+		}
+		mode = models.ReservePartial
+	}
+	if mode == "" {
+		mode = models.ReserveAllOrNothing
+	}
+	if mode != models.ReserveAllOrNothing && mode != models.ReservePartial {
+		return badRequest("mode must be all_or_nothing or partial")
 	}
 
-	updates := make([]models.UpdateWarehouseProductInput, len(reserveData.Reservations))
+	strategy, err := allocation.ParseStrategy(reserveData.Strategy)
+	if err != nil {
+		return badRequest("strategy must be most_available, priority or fewest_splits")
+	}
 
+	lines := make([]models.StockLine, len(reserveData.Reservations))
 	for i, reservation := range reserveData.Reservations {
-		wp, err := s.Storage.GetWPByProductCode(context.TODO(), models.GetWPByProductCodeFilter{WarehouseID: &reservation.WarehouseID, ProductCode: &reservation.Code})
-		if err != nil {
-			s.logger.Error("Server", slog.String("requestID", requestID),
-				slog.String("error", fmt.Sprintf("Unable to get stored products in warehouse: %v", err.Error())))
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Unable to get stored products in warehouse: %v", err.Error())})
+		if err := validateLinePacks(reservation.Quantity, reservation.Pack, reservation.Packs); err != nil {
+			return err
+		}
+		if err := validateLineProduct(reservation.Code, reservation.Barcode, reservation.Quantity > 0 || reservation.Pack != ""); err != nil {
+			return err
 		}
-		if wp == nil {
-			s.logger.Info("Server", slog.String("requestID", requestID),
-				slog.String("error", "No products in warehouse"))
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "No products in warehouse"})
+		if reserveData.Backorder && reservation.WarehouseID == 0 {
+			return badRequest("warehouse_id is required for backorder")
 		}
+		lines[i] = models.StockLine{WarehouseID: reservation.WarehouseID, Code: reservation.Code,
+			Barcode: reservation.Barcode, Quantity: reservation.Quantity, Pack: reservation.Pack, Packs: reservation.Packs.String()}
+	}
+	if err := s.convertPacks(c.Request().Context(), lines); err != nil {
+		return err
+	}
+
+	id, results, err := s.Storage.CreateReservation(c.Request().Context(), models.CreateReservationInput{
+		OrderRef:  reserveData.OrderRef,
+		TTL:       ttl,
+		Mode:      mode,
+		Strategy:  string(strategy),
+		Backorder: reserveData.Backorder,
+		Lines:     lines,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to create reservation: %w", err)
+	}
 
-		reserved := wp.ReservedQuantity + reservation.Quantity
-		if reserved > wp.Quantity {
-			s.logger.Info("Server", slog.String("requestID", requestID),
-				slog.String("error", "Can't reserve more than have"))
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Can't reserve more than have"})
+	var failed []models.StockLineResult
+	var reasons []string
+	backordered := false
+	for _, result := range results {
+		if result.Reason != "" {
+			failed = append(failed, result)
+			reasons = append(reasons, result.Reason)
 		}
+		if result.Backordered > 0 {
+			backordered = true
+		}
+	}
 
-		updates[i] = models.UpdateWarehouseProductInput{WarehouseID: &wp.WarehouseID, ProductID: &wp.ProductID, Quantity: &wp.Quantity, ReservedQuantity: &reserved}
+	if id == 0 {
+		if mode == models.ReservePartial {
+			return c.JSON(http.StatusOK, map[string]interface{}{"Reserved": "NONE", "reservation": nil, "results": results})
+		}
+		return failedLinesError(reasons, "Can't reserve more than have", failed)
 	}
-	err := s.Storage.UpdateWPBatch(context.TODO(), updates)
+
+	reservations, err := s.Storage.GetReservations(c.Request().Context(), models.GetReservationsFilter{IDs: []int{id}})
 	if err != nil {
-		s.logger.Error("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("Unable to update warehouse_product records: %v", err.Error())))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Unable to update warehouse_product records: %v", err.Error())})
+		return fmt.Errorf("Unable to get reservation %d: %w", id, err)
+	}
+	if len(reservations) == 0 {
+		return fmt.Errorf("Unable to get reservation %d", id)
+	}
+
+	status := "OK"
+	if backordered {
+		status = "BACKORDERED"
+	} else if len(failed) > 0 {
+		status = "PARTIAL"
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{"Reserved": "OK"})
+	return c.JSON(http.StatusOK, map[string]interface{}{"Reserved": status, "reservation": reservations[0], "results": results})
 
 }
 
 func (s *Server) ReleaseProductHandler(c echo.Context) error {
-	requestID := c.Get("requestID").(string)
 	var releaseData ReleaseDTO
 	if err := c.Bind(&releaseData); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return badRequest("invalid request body")
 	}
 
-	if len(releaseData.Releases) < 1 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Empty request"})
+	if releaseData.ReservationID != 0 {
+		err := s.Storage.ReleaseReservation(c.Request().Context(), releaseData.ReservationID)
+		if err != nil {
+			return fmt.Errorf("Unable to release reservation: %w", err)
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"Released": "OK", "reservation_id": releaseData.ReservationID})
 	}
 
-	updates := make([]models.UpdateWarehouseProductInput, len(releaseData.Releases))
+	if len(releaseData.Releases) < 1 {
+		return badRequest("Empty request")
+	}
 
-	for i, reservation := range releaseData.Releases {
-		wp, err := s.Storage.GetWPByProductCode(context.TODO(), models.GetWPByProductCodeFilter{WarehouseID: &reservation.WarehouseID, ProductCode: &reservation.Code})
-		if err != nil {
-			s.logger.Error("Server", slog.String("requestID", requestID),
-				slog.String("error", fmt.Sprintf("Unable to get stored products in warehouse: %v", err.Error())))
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Unable to get stored products in warehouse: %v", err.Error())})
+	lines := make([]models.StockLine, len(releaseData.Releases))
+	for i, release := range releaseData.Releases {
+		if err := validateLinePacks(release.Quantity, release.Pack, release.Packs); err != nil {
+			return err
 		}
-		if wp == nil {
-			s.logger.Info("Server", slog.String("requestID", requestID),
-				slog.String("error", "No products in warehouse"))
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "No products in warehouse"})
+		if err := validateLineProduct(release.Code, release.Barcode, release.Quantity > 0 || release.Pack != ""); err != nil {
+			return err
 		}
+		lines[i] = models.StockLine{WarehouseID: release.WarehouseID, Code: release.Code, Barcode: release.Barcode,
+			Quantity: release.Quantity, Pack: release.Pack, Packs: release.Packs.String()}
+	}
+	if err := s.convertPacks(c.Request().Context(), lines); err != nil {
+		return err
+	}
 
-		released := wp.ReservedQuantity - reservation.Quantity
-		if released < 0 {
-			s.logger.Info("Server", slog.String("requestID", requestID),
-				slog.String("error", "Can't release more than have"))
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Can't release more than have"})
+	failed, err := s.Storage.ReleaseWP(c.Request().Context(), lines)
+	if err != nil {
+		return fmt.Errorf("Unable to update warehouse_product records: %w", err)
+	}
+	if len(failed) > 0 {
+		reasons := make([]string, len(failed))
+		for i, line := range failed {
+			reasons[i] = line.Reason
 		}
+		return failedLinesError(reasons, "Can't release more than have", failed)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Released": "OK"})
+
+}
 
-		updates[i] = models.UpdateWarehouseProductInput{WarehouseID: &wp.WarehouseID, ProductID: &wp.ProductID, Quantity: &wp.Quantity, ReservedQuantity: &released}
+// failedLinesError keeps the error messages of the API stable for the failed stock lines.
+// Unknown products take precedence over blocked warehouses, other reasons get the insufficient message
+func failedLinesError(reasons []string, insufficient string, failed interface{}) error {
+	for _, reason := range reasons {
+		if reason == models.ReasonNotFound {
+			return &storage.StockLinesError{Message: "No products in warehouse", Reason: reason, Failed: failed}
+		}
+	}
+	for _, reason := range reasons {
+		if reason == models.ReasonWarehouseUnavailable {
+			return &storage.StockLinesError{Message: "Warehouse is unavailable", Reason: reason, Failed: failed}
+		}
 	}
-	err := s.Storage.UpdateWPBatch(context.TODO(), updates)
+	reason := models.ReasonInsufficientStock
+	if len(reasons) > 0 {
+		reason = reasons[0]
+	}
+	return &storage.StockLinesError{Message: insufficient, Reason: reason, Failed: failed}
+}
+
+func (s *Server) GetReservationHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		s.logger.Error("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("Unable to update warehouse_product records: %v", err.Error())))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Unable to update warehouse_product records: %v", err.Error())})
+		return badRequest("invalid reservation id")
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{"Released": "OK"})
+	reservations, err := s.Storage.GetReservations(c.Request().Context(), models.GetReservationsFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get reservation: %w", err)
+	}
+	if len(reservations) == 0 {
+		return notFound(fmt.Sprintf("No reservation with ID: %d", id))
+	}
 
+	return c.JSON(http.StatusOK, reservations[0])
 }
 
-func (s *Server) GetWarehouseHandler(c echo.Context) error {
+func (s *Server) ShipHandler(c echo.Context) error {
 	requestID := c.Get("requestID").(string)
-	var warehouseProducts WarehouseProductsDTO
-	if err := c.Bind(&warehouseProducts); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	var shipData ShipDTO
+	if err := c.Bind(&shipData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if shipData.ReservationID <= 0 {
+		return badRequest("reservation_id is required")
+	}
+
+	lines := make([]models.StockLine, len(shipData.Lines))
+	for i, ship := range shipData.Lines {
+		if ship.Code == "" || ship.Quantity <= 0 {
+			return badRequest("code and positive quantity are required")
+		}
+		lines[i] = models.StockLine{WarehouseID: ship.WarehouseID, Code: ship.Code, Quantity: ship.Quantity}
 	}
 
-	wp, err := s.Storage.GetWP(context.TODO(), models.GetWarehouseProductFilter{WarehouseID: warehouseProducts.WarehouseID})
+	id, failed, err := s.Storage.CreateShipment(c.Request().Context(), models.CreateShipmentInput{
+		ReservationID: shipData.ReservationID,
+		Lines:         lines,
+	})
 	if err != nil {
-		fmt.Println(&warehouseProducts.WarehouseID)
+		return fmt.Errorf("Unable to ship reservation: %w", err)
+	}
+	if len(failed) > 0 {
+		reasons := make([]string, len(failed))
+		for i, line := range failed {
+			reasons[i] = line.Reason
+		}
+		return failedLinesError(reasons, "Can't ship more than reserved", failed)
+	}
+
+	shipments, err := s.Storage.GetShipments(c.Request().Context(), models.GetShipmentsFilter{IDs: []int{id}})
+	if err != nil || len(shipments) == 0 {
 		s.logger.Error("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("Unable to get warehouse products: %v", err.Error())))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Unable to get warehouse products: %v", err.Error())})
+			slog.String("error", fmt.Sprintf("Unable to get shipment %d: %v", id, err)))
+		return c.JSON(http.StatusOK, map[string]interface{}{"Shipped": "OK", "shipment_id": id})
 	}
 
-	if wp == nil {
-		s.logger.Info("Server", slog.String("requestID", requestID),
-			slog.String("error", "No products in warehouse"))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "No products in warehouse"})
+	return c.JSON(http.StatusOK, map[string]interface{}{"Shipped": "OK", "shipment": shipments[0]})
+}
+
+func (s *Server) GetShipmentHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid shipment id")
 	}
 
-	return c.JSON(http.StatusOK, wp)
+	shipments, err := s.Storage.GetShipments(c.Request().Context(), models.GetShipmentsFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get shipment: %w", err)
+	}
+	if len(shipments) == 0 {
+		return notFound(fmt.Sprintf("No shipment with ID: %d", id))
+	}
 
+	return c.JSON(http.StatusOK, shipments[0])
 }
 
-func (s *Server) BlockWarehouseHandler(c echo.Context) error {
+func (s *Server) ReceiveHandler(c echo.Context) error {
 	requestID := c.Get("requestID").(string)
-	False := false
-	var warehouse BlockWarehouseDTO
-	if err := c.Bind(&warehouse); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	var receiveData ReceiveDTO
+	if err := c.Bind(&receiveData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if receiveData.Number == "" || receiveData.WarehouseID <= 0 {
+		return badRequest("number and warehouse_id are required")
+	}
+	if len(receiveData.Lines) < 1 {
+		return badRequest("Empty request")
+	}
+
+	lines := make([]models.StockLine, len(receiveData.Lines))
+	for i, receive := range receiveData.Lines {
+		if err := validateLinePacks(receive.Quantity, receive.Pack, receive.Packs); err != nil {
+			return err
+		}
+		if err := validateLineProduct(receive.Code, receive.Barcode, receive.Quantity > 0 || receive.Pack != ""); err != nil {
+			return err
+		}
+		lines[i] = models.StockLine{Code: receive.Code, Barcode: receive.Barcode, Quantity: receive.Quantity,
+			Pack: receive.Pack, Packs: receive.Packs.String()}
 	}
-	wps, err := s.Storage.GetWarehouses(context.TODO(), models.GetWarehousesFilter{IDs: []int{warehouse.WarehouseID}})
+	if err := s.convertPacks(c.Request().Context(), lines); err != nil {
+		return err
+	}
+
+	id, created, failed, err := s.Storage.CreateReceipt(c.Request().Context(), models.CreateReceiptInput{
+		Number:      receiveData.Number,
+		WarehouseID: receiveData.WarehouseID,
+		SupplierRef: receiveData.SupplierRef,
+		Lines:       lines,
+	})
 	if err != nil {
+		return fmt.Errorf("Unable to receive goods: %w", err)
+	}
+	if len(failed) > 0 {
+		return &storage.StockLinesError{Message: "Unknown products in receipt", Reason: models.ReasonNotFound, Failed: failed}
+	}
+
+	status := "OK"
+	if !created {
+		status = "ALREADY_RECEIVED"
+	}
+
+	receipts, err := s.Storage.GetReceipts(c.Request().Context(), models.GetReceiptsFilter{IDs: []int{id}})
+	if err != nil || len(receipts) == 0 {
 		s.logger.Error("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("Unable to get warehouse: %v", err.Error())))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Unable to get warehouse: %v", err.Error())})
+			slog.String("error", fmt.Sprintf("Unable to get receipt %d: %v", id, err)))
+		return c.JSON(http.StatusOK, map[string]interface{}{"Received": status, "receipt_id": id})
 	}
-	if wps == nil {
-		s.logger.Info("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("No warehouse with ID: %d", warehouse.WarehouseID)))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("No warehouse with ID: %d", warehouse.WarehouseID)})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Received": status, "receipt": receipts[0]})
+}
+
+func (s *Server) GetReceiptHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid receipt id")
 	}
-	err = s.Storage.UpdateWarehouse(context.TODO(), &models.UpdateWarehouseInput{ID: wps[0].ID, Name: &wps[0].Name, Availability: &False})
+
+	receipts, err := s.Storage.GetReceipts(c.Request().Context(), models.GetReceiptsFilter{IDs: []int{id}})
 	if err != nil {
-		s.logger.Error("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("Unable to update warehouse: %v", err.Error())))
-		return c.JSON(http.StatusInternalServerError,
-			map[string]string{"error": fmt.Sprintf("Unable to update warehouse: %v", err.Error())})
+		return fmt.Errorf("Unable to get receipt: %w", err)
 	}
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"Blocked": "OK",
+	if len(receipts) == 0 {
+		return notFound(fmt.Sprintf("No receipt with ID: %d", id))
+	}
+
+	return c.JSON(http.StatusOK, receipts[0])
+}
+
+func (s *Server) CreateTransferHandler(c echo.Context) error {
+	requestID := c.Get("requestID").(string)
+	var transferData TransferDTO
+	if err := c.Bind(&transferData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if transferData.SourceWarehouseID <= 0 || transferData.DestinationWarehouseID <= 0 {
+		return badRequest("source_warehouse_id and destination_warehouse_id are required")
+	}
+	if transferData.SourceWarehouseID == transferData.DestinationWarehouseID {
+		return badRequest("source and destination warehouses must differ")
+	}
+	if len(transferData.Lines) < 1 {
+		return badRequest("Empty request")
+	}
+
+	lines := make([]models.StockLine, len(transferData.Lines))
+	for i, transfer := range transferData.Lines {
+		if err := validateLinePacks(transfer.Quantity, transfer.Pack, transfer.Packs); err != nil {
+			return err
+		}
+		if transfer.Code == "" || (transfer.Quantity <= 0 && transfer.Pack == "") {
+			return badRequest("code and positive quantity are required")
+		}
+		lines[i] = models.StockLine{Code: transfer.Code, Quantity: transfer.Quantity, Pack: transfer.Pack, Packs: transfer.Packs.String()}
+	}
+	if err := s.convertPacks(c.Request().Context(), lines); err != nil {
+		return err
+	}
+
+	id, failed, err := s.Storage.CreateTransfer(c.Request().Context(), models.CreateTransferInput{
+		SourceWarehouseID:      transferData.SourceWarehouseID,
+		DestinationWarehouseID: transferData.DestinationWarehouseID,
+		Lines:                  lines,
 	})
+	if err != nil {
+		return fmt.Errorf("Unable to create transfer: %w", err)
+	}
+	if len(failed) > 0 {
+		return transferFailed(failed)
+	}
+
+	return s.transferResponse(c, requestID, "Created", id)
 }
 
-func (s *Server) UnblockWarehouseHandler(c echo.Context) error {
+func (s *Server) GetTransferHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid transfer id")
+	}
+
+	transfers, err := s.Storage.GetTransfers(c.Request().Context(), models.GetTransfersFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get transfer: %w", err)
+	}
+	if len(transfers) == 0 {
+		return notFound(fmt.Sprintf("No transfer with ID: %d", id))
+	}
+
+	return c.JSON(http.StatusOK, transfers[0])
+}
+
+func (s *Server) DispatchTransferHandler(c echo.Context) error {
+	return s.changeTransferStatus(c, "Dispatched", s.Storage.DispatchTransfer)
+}
+
+func (s *Server) ReceiveTransferHandler(c echo.Context) error {
+	return s.changeTransferStatus(c, "Received", s.Storage.ReceiveTransfer)
+}
+
+func (s *Server) CancelTransferHandler(c echo.Context) error {
+	return s.changeTransferStatus(c, "Cancelled", s.Storage.CancelTransfer)
+}
+
+func (s *Server) changeTransferStatus(c echo.Context, done string, change func(ctx context.Context, id int) ([]models.FailedStockLine, error)) error {
 	requestID := c.Get("requestID").(string)
-	True := true
-	var warehouse BlockWarehouseDTO
-	if err := c.Bind(&warehouse); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid transfer id")
 	}
-	wps, err := s.Storage.GetWarehouses(context.TODO(), models.GetWarehousesFilter{IDs: []int{warehouse.WarehouseID}})
+
+	failed, err := change(c.Request().Context(), id)
 	if err != nil {
+		return fmt.Errorf("Unable to update transfer: %w", err)
+	}
+	if len(failed) > 0 {
+		return transferFailed(failed)
+	}
+
+	return s.transferResponse(c, requestID, done, id)
+}
+
+func transferFailed(failed []models.FailedStockLine) error {
+	reasons := make([]string, len(failed))
+	for i, line := range failed {
+		reasons[i] = line.Reason
+	}
+	return failedLinesError(reasons, "Can't transfer more than have", failed)
+}
+
+func (s *Server) transferResponse(c echo.Context, requestID string, done string, id int) error {
+	transfers, err := s.Storage.GetTransfers(c.Request().Context(), models.GetTransfersFilter{IDs: []int{id}})
+	if err != nil || len(transfers) == 0 {
 		s.logger.Error("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("Unable to get warehouse: %v", err.Error())))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Unable to get warehouse: %v", err.Error())})
+			slog.String("error", fmt.Sprintf("Unable to get transfer %d: %v", id, err)))
+		return c.JSON(http.StatusOK, map[string]interface{}{done: "OK", "transfer_id": id})
 	}
-	if wps == nil {
-		s.logger.Info("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("No warehouse with ID: %d", warehouse.WarehouseID)))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("No warehouse with ID: %d", warehouse.WarehouseID)})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{done: "OK", "transfer": transfers[0]})
+}
+
+// GetMovementsHandler returns a page of the stock movements filtered by warehouse_id, product_id or code, type
+// and the [from, to) time range given in RFC 3339
+func (s *Server) GetMovementsHandler(c echo.Context) error {
+	var filter models.GetStockMovementsFilter
+	var err error
+	if filter.Page, err = parsePage(c); err != nil {
+		return err
+	}
+	if warehouseID := c.QueryParam("warehouse_id"); warehouseID != "" {
+		if filter.WarehouseID, err = strconv.Atoi(warehouseID); err != nil {
+			return badRequest("invalid warehouse_id")
+		}
+	}
+	if productID := c.QueryParam("product_id"); productID != "" {
+		if filter.ProductID, err = strconv.Atoi(productID); err != nil {
+			return badRequest("invalid product_id")
+		}
+	}
+	filter.ProductCode = c.QueryParam("code")
+	for _, movementType := range c.QueryParams()["type"] {
+		filter.Types = append(filter.Types, models.MovementType(movementType))
+	}
+	for name, bound := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := c.QueryParam(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return badRequest(fmt.Sprintf("%s must be in RFC 3339 format", name))
+			}
+			t = t.UTC()
+			*bound = &t
+		}
 	}
-	err = s.Storage.UpdateWarehouse(context.TODO(), &models.UpdateWarehouseInput{ID: wps[0].ID, Name: &wps[0].Name, Availability: &True})
+
+	movements, next, err := s.Storage.GetStockMovements(c.Request().Context(), filter)
 	if err != nil {
-		s.logger.Error("Server", slog.String("requestID", requestID),
-			slog.String("error", fmt.Sprintf("Unable to update warehouse: %v", err.Error())))
-		return c.JSON(http.StatusInternalServerError,
-			map[string]string{"error": fmt.Sprintf("Unable to update warehouse: %v", err.Error())})
+		return fmt.Errorf("Unable to get stock movements: %w", err)
 	}
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"Unblocked": "OK",
+	if movements == nil {
+		movements = []*models.StockMovement{}
+	}
+
+	return c.JSON(http.StatusOK, pageResponse{Items: movements, NextCursor: next})
+}
+
+// GetStockAsOfHandler returns warehouse products with quantities as of the time given by at in RFC 3339,
+// optionally filtered by warehouse_id and product_id
+func (s *Server) GetStockAsOfHandler(c echo.Context) error {
+	at, err := time.Parse(time.RFC3339, c.QueryParam("at"))
+	if err != nil {
+		return badRequest("at is required in RFC 3339 format")
+	}
+
+	var filter models.GetWarehouseProductFilter
+	if warehouseID := c.QueryParam("warehouse_id"); warehouseID != "" {
+		if filter.WarehouseID, err = strconv.Atoi(warehouseID); err != nil {
+			return badRequest("invalid warehouse_id")
+		}
+	}
+	if productID := c.QueryParam("product_id"); productID != "" {
+		if filter.ProductID, err = strconv.Atoi(productID); err != nil {
+			return badRequest("invalid product_id")
+		}
+	}
+
+	wp, err := s.Storage.GetWPAsOf(c.Request().Context(), filter, at.UTC())
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse products: %w", err)
+	}
+	if wp == nil {
+		wp = []*models.WarehouseProduct{}
+	}
+
+	return c.JSON(http.StatusOK, wp)
+}
+
+func (s *Server) AdjustHandler(c echo.Context) error {
+	var adjustData AdjustDTO
+	if err := c.Bind(&adjustData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if len(adjustData.Lines) < 1 {
+		return badRequest("Empty request")
+	}
+
+	adjustments := make([]models.StockAdjustment, len(adjustData.Lines))
+	for i, adjust := range adjustData.Lines {
+		if adjust.Code == "" || adjust.Quantity == 0 {
+			return badRequest("code and non-zero quantity are required")
+		}
+		reason, err := models.ParseAdjustmentReason(adjust.Reason)
+		if err != nil {
+			return badRequest("reason must be damage, loss or count_correction")
+		}
+		adjustments[i] = models.StockAdjustment{
+			StockLine: models.StockLine{WarehouseID: adjust.WarehouseID, Code: adjust.Code, Quantity: adjust.Quantity},
+			Reason:    reason,
+		}
+	}
+
+	failed, err := s.Storage.AdjustWP(c.Request().Context(), adjustments, adjustData.Override)
+	if err != nil {
+		return fmt.Errorf("Unable to adjust stock: %w", err)
+	}
+	if len(failed) > 0 {
+		return stocktakeFailed(failed)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Adjusted": "OK"})
+}
+
+func (s *Server) CreateStocktakeHandler(c echo.Context) error {
+	var stocktakeData StocktakeDTO
+	if err := c.Bind(&stocktakeData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if stocktakeData.WarehouseID <= 0 {
+		return badRequest("warehouse_id is required")
+	}
+
+	id, err := s.Storage.CreateStocktake(c.Request().Context(), stocktakeData.WarehouseID)
+	if err != nil {
+		return fmt.Errorf("Unable to create stocktake: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Created": "OK", "stocktake_id": id})
+}
+
+func (s *Server) GetStocktakeHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stocktake id")
+	}
+
+	stocktakes, err := s.Storage.GetStocktakes(c.Request().Context(), models.GetStocktakesFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get stocktake: %w", err)
+	}
+	if len(stocktakes) == 0 {
+		return notFound(fmt.Sprintf("No stocktake with ID: %d", id))
+	}
+
+	return c.JSON(http.StatusOK, stocktakes[0])
+}
+
+func (s *Server) SubmitStocktakeCountsHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stocktake id")
+	}
+
+	var countsData StocktakeCountsDTO
+	if err := c.Bind(&countsData); err != nil {
+		return badRequest("invalid request body")
+	}
+	if len(countsData.Counts) < 1 {
+		return badRequest("Empty request")
+	}
+
+	counts := make([]models.StocktakeCount, len(countsData.Counts))
+	for i, count := range countsData.Counts {
+		if count.Code == "" || count.Quantity < 0 {
+			return badRequest("code and non-negative quantity are required")
+		}
+		reason, err := models.ParseAdjustmentReason(count.Reason)
+		if err != nil {
+			return badRequest("reason must be damage, loss or count_correction")
+		}
+		counts[i] = models.StocktakeCount{Code: count.Code, Quantity: count.Quantity, Reason: reason}
+	}
+
+	failed, err := s.Storage.SubmitStocktakeCounts(c.Request().Context(), models.SubmitStocktakeCountsInput{StocktakeID: id, Counts: counts})
+	if err != nil {
+		return fmt.Errorf("Unable to submit stocktake counts: %w", err)
+	}
+	if len(failed) > 0 {
+		return stocktakeFailed(failed)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Counted": "OK"})
+}
+
+func (s *Server) GetStocktakeVarianceHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stocktake id")
+	}
+
+	variances, err := s.Storage.GetStocktakeVariance(c.Request().Context(), id)
+	if err != nil {
+		return fmt.Errorf("Unable to get stocktake variance: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, variances)
+}
+
+func (s *Server) ApplyStocktakeHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stocktake id")
+	}
+
+	// The body is optional, without it the stocktake is applied without override
+	var applyData ApplyStocktakeDTO
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&applyData); err != nil {
+			return badRequest("invalid request body")
+		}
+	}
+
+	failed, err := s.Storage.ApplyStocktake(c.Request().Context(), id, applyData.Override)
+	if err != nil {
+		return fmt.Errorf("Unable to apply stocktake: %w", err)
+	}
+	if len(failed) > 0 {
+		return stocktakeFailed(failed)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Applied": "OK", "stocktake_id": id})
+}
+
+func (s *Server) CancelStocktakeHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stocktake id")
+	}
+
+	err = s.Storage.CancelStocktake(c.Request().Context(), id)
+	if err != nil {
+		return fmt.Errorf("Unable to cancel stocktake: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Cancelled": "OK", "stocktake_id": id})
+}
+
+func stocktakeFailed(failed []models.FailedStockLine) error {
+	reasons := make([]string, len(failed))
+	for i, line := range failed {
+		reasons[i] = line.Reason
+	}
+	return failedLinesError(reasons, "Quantity can't drop below reserved quantity", failed)
+}
+
+func (s *Server) SetThresholdsHandler(c echo.Context) error {
+	var thresholdsData ThresholdsDTO
+	if err := c.Bind(&thresholdsData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if len(thresholdsData.Lines) < 1 {
+		return badRequest("Empty request")
+	}
+
+	inputs := make([]models.UpdateWarehouseProductInput, len(thresholdsData.Lines))
+	for i := range thresholdsData.Lines {
+		threshold := &thresholdsData.Lines[i]
+		if threshold.Code == "" || threshold.WarehouseID <= 0 {
+			return badRequest("code and warehouse_id are required")
+		}
+		if threshold.MinLevel < 0 || threshold.ReorderPoint < 0 {
+			return badRequest("min_level and reorder_point can't be negative")
+		}
+
+		wp, err := s.Storage.GetWPByProductCode(c.Request().Context(),
+			models.GetWPByProductCodeFilter{WarehouseID: &threshold.WarehouseID, ProductCode: &threshold.Code})
+		if errors.Is(err, storage.ErrNotFound) {
+			return notFound(fmt.Sprintf("No product %s in warehouse %d", threshold.Code, threshold.WarehouseID))
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to get warehouse product: %w", err)
+		}
+
+		inputs[i] = models.UpdateWarehouseProductInput{ID: wp.ID, MinLevel: &threshold.MinLevel, ReorderPoint: &threshold.ReorderPoint}
+	}
+
+	if err := s.Storage.UpdateWPBatch(c.Request().Context(), inputs); err != nil {
+		return fmt.Errorf("Unable to update thresholds: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Updated": "OK"})
+}
+
+func (s *Server) SetSafetyStockHandler(c echo.Context) error {
+	var safetyStockData SafetyStockDTO
+	if err := c.Bind(&safetyStockData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if safetyStockData.WarehouseID <= 0 {
+		return badRequest("warehouse_id is required")
+	}
+	if safetyStockData.Default == nil && len(safetyStockData.Lines) < 1 {
+		return badRequest("Empty request")
+	}
+	if safetyStockData.Default != nil && *safetyStockData.Default < 0 {
+		return badRequest("safety stock can't be negative")
+	}
+
+	wps, _, err := s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{safetyStockData.WarehouseID}})
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse: %w", err)
+	}
+	if wps == nil {
+		return notFound(fmt.Sprintf("No warehouse with ID: %d", safetyStockData.WarehouseID))
+	}
+
+	inputs := make([]models.UpdateWarehouseProductInput, len(safetyStockData.Lines))
+	for i, line := range safetyStockData.Lines {
+		if line.Code == "" {
+			return badRequest("code is required")
+		}
+		if line.SafetyStock != nil && *line.SafetyStock < 0 {
+			return badRequest("safety stock can't be negative")
+		}
+
+		wp, err := s.Storage.GetWPByProductCode(c.Request().Context(),
+			models.GetWPByProductCodeFilter{WarehouseID: &safetyStockData.WarehouseID, ProductCode: &safetyStockData.Lines[i].Code})
+		if errors.Is(err, storage.ErrNotFound) {
+			return notFound(fmt.Sprintf("No product %s in warehouse %d", line.Code, safetyStockData.WarehouseID))
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to get warehouse product: %w", err)
+		}
+
+		inputs[i] = models.UpdateWarehouseProductInput{ID: wp.ID, SafetyStock: line.SafetyStock, ResetSafetyStock: line.SafetyStock == nil}
+	}
+
+	if safetyStockData.Default != nil {
+		err = s.Storage.UpdateWarehouse(c.Request().Context(), &models.UpdateWarehouseInput{ID: wps[0].ID, SafetyStock: safetyStockData.Default})
+		if err != nil {
+			return fmt.Errorf("Unable to update warehouse: %w", err)
+		}
+	}
+	if len(inputs) > 0 {
+		if err = s.Storage.UpdateWPBatch(c.Request().Context(), inputs); err != nil {
+			return fmt.Errorf("Unable to update safety stock: %w", err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Updated": "OK"})
+}
+
+// GetLowStockHandler returns products of the warehouse whose available stock is below their thresholds
+func (s *Server) GetLowStockHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid warehouse id")
+	}
+
+	items, err := s.Storage.GetLowStock(c.Request().Context(), id)
+	if err != nil {
+		return fmt.Errorf("Unable to get low stock: %w", err)
+	}
+	if items == nil {
+		items = []*models.LowStockItem{}
+	}
+
+	return c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) GetStockAlertsHandler(c echo.Context) error {
+	var filter models.GetStockAlertsFilter
+	var err error
+	if warehouseID := c.QueryParam("warehouse_id"); warehouseID != "" {
+		if filter.WarehouseID, err = strconv.Atoi(warehouseID); err != nil {
+			return badRequest("invalid warehouse_id")
+		}
+	}
+	if open := c.QueryParam("open"); open != "" {
+		if filter.OnlyOpen, err = strconv.ParseBool(open); err != nil {
+			return badRequest("invalid open")
+		}
+	}
+
+	alerts, err := s.Storage.GetStockAlerts(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get stock alerts: %w", err)
+	}
+	if alerts == nil {
+		alerts = []*models.StockAlert{}
+	}
+
+	return c.JSON(http.StatusOK, alerts)
+}
+
+// GetEventsHandler returns notification events after after_id, consumers poll it with the last id they have seen
+func (s *Server) GetEventsHandler(c echo.Context) error {
+	var filter models.GetEventsFilter
+	var err error
+	if afterID := c.QueryParam("after_id"); afterID != "" {
+		if filter.AfterID, err = strconv.ParseInt(afterID, 10, 64); err != nil {
+			return badRequest("invalid after_id")
+		}
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			return badRequest("invalid limit")
+		}
+	}
+	filter.Types = c.QueryParams()["type"]
+
+	events, err := s.Storage.GetEvents(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get events: %w", err)
+	}
+	if events == nil {
+		events = []*models.Event{}
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
+
+// parsePage reads limit, sort and cursor of a list page from the query
+func parsePage(c echo.Context) (models.PageFilter, error) {
+	page := models.PageFilter{
+		Limit:  defaultPageLimit,
+		Sort:   c.QueryParam("sort"),
+		Cursor: c.QueryParam("cursor"),
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		var err error
+		if page.Limit, err = strconv.Atoi(limit); err != nil || page.Limit <= 0 || page.Limit > maxPageLimit {
+			return page, badRequest(fmt.Sprintf("limit must be from 1 to %d", maxPageLimit))
+		}
+	}
+
+	return page, nil
+}
+
+// parseStocksFilter reads filters and the page of stock lists from the query
+func parseStocksFilter(c echo.Context) (models.GetWarehouseProductFilter, error) {
+	var filter models.GetWarehouseProductFilter
+	var err error
+	if filter.Page, err = parsePage(c); err != nil {
+		return filter, err
+	}
+	if minAvailable := c.QueryParam("min_available"); minAvailable != "" {
+		available, err := strconv.Atoi(minAvailable)
+		if err != nil {
+			return filter, badRequest("invalid min_available")
+		}
+		filter.MinAvailable = &available
+	}
+	if availability := c.QueryParam("availability"); availability != "" {
+		available, err := strconv.ParseBool(availability)
+		if err != nil {
+			return filter, badRequest("invalid availability")
+		}
+		filter.Availability = &available
+	}
+
+	return filter, nil
+}
+
+// GetWarehouseProductsHandler returns a page of the stock of the warehouse products
+func (s *Server) GetWarehouseProductsHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid warehouse id")
+	}
+
+	filter, err := parseStocksFilter(c)
+	if err != nil {
+		return err
+	}
+	filter.WarehouseID = id
+
+	wp, next, err := s.Storage.GetWP(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse products: %w", err)
+	}
+
+	// An empty page is only an error when the warehouse itself doesn't exist
+	if len(wp) == 0 {
+		warehouses, _, err := s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{id}})
+		if err != nil {
+			return fmt.Errorf("Unable to get warehouse: %w", err)
+		}
+		if len(warehouses) == 0 {
+			return notFound(fmt.Sprintf("No warehouse with ID: %d", id))
+		}
+		wp = []*models.WarehouseProduct{}
+	}
+
+	return c.JSON(http.StatusOK, pageResponse{Items: wp, NextCursor: next})
+}
+
+// GetWarehousesHandler returns a page of warehouses filtered by id, name and availability
+func (s *Server) GetWarehousesHandler(c echo.Context) error {
+	var filter models.GetWarehousesFilter
+	var err error
+	if filter.Page, err = parsePage(c); err != nil {
+		return err
+	}
+	for _, value := range c.QueryParams()["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return badRequest("invalid id")
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+	filter.Name = c.QueryParam("name")
+	if availability := c.QueryParam("availability"); availability != "" {
+		available, err := strconv.ParseBool(availability)
+		if err != nil {
+			return badRequest("invalid availability")
+		}
+		filter.Availability = &available
+	}
+
+	warehouses, next, err := s.Storage.GetWarehouses(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouses: %w", err)
+	}
+	if warehouses == nil {
+		warehouses = []*models.Warehouse{}
+	}
+
+	return c.JSON(http.StatusOK, pageResponse{Items: warehouses, NextCursor: next})
+}
+
+func (s *Server) GetWarehouseByIDHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid warehouse id")
+	}
+
+	warehouses, _, err := s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse: %w", err)
+	}
+	if len(warehouses) == 0 {
+		return notFound(fmt.Sprintf("No warehouse with ID: %d", id))
+	}
+
+	return c.JSON(http.StatusOK, warehouses[0])
+}
+
+func (s *Server) CreateWarehouseHandler(c echo.Context) error {
+	var warehouseData WarehouseDTO
+	if err := c.Bind(&warehouseData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if err := validateLength("name", warehouseData.Name, maxWarehouseNameLength); err != nil {
+		return err
+	}
+	if warehouseData.SafetyStock < 0 {
+		return badRequest("safety_stock can't be negative")
+	}
+
+	warehouse := models.Warehouse{
+		Name:         warehouseData.Name,
+		Availability: true,
+		Priority:     warehouseData.Priority,
+		SafetyStock:  warehouseData.SafetyStock,
+	}
+	if warehouseData.Availability != nil {
+		warehouse.Availability = *warehouseData.Availability
+	}
+
+	id, err := s.Storage.CreateWarehouse(c.Request().Context(), warehouse)
+	if err != nil {
+		return fmt.Errorf("Unable to create warehouse: %w", err)
+	}
+	warehouse.ID = id
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Created":   "OK",
+		"warehouse": warehouse,
+	})
+}
+
+// UpdateWarehouseHandler changes the given fields of the warehouse. Making an available warehouse unavailable
+// moves its reservations under the move block policy, the same as POST /block
+func (s *Server) UpdateWarehouseHandler(c echo.Context) error {
+	requestID := c.Get("requestID").(string)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid warehouse id")
+	}
+
+	var input models.UpdateWarehouseInput
+	if err := c.Bind(&input); err != nil {
+		return badRequest("invalid request body")
+	}
+	input.ID = id
+
+	if input.Name == nil && input.Availability == nil && input.Priority == nil && input.SafetyStock == nil {
+		return badRequest("Empty request")
+	}
+	if input.Name != nil {
+		if err := validateLength("name", *input.Name, maxWarehouseNameLength); err != nil {
+			return err
+		}
+	}
+	if input.SafetyStock != nil && *input.SafetyStock < 0 {
+		return badRequest("safety_stock can't be negative")
+	}
+
+	warehouses, _, err := s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse: %w", err)
+	}
+	if len(warehouses) == 0 {
+		return notFound(fmt.Sprintf("No warehouse with ID: %d", id))
+	}
+
+	err = s.Storage.UpdateWarehouse(c.Request().Context(), &input)
+	if err != nil {
+		return fmt.Errorf("Unable to update warehouse: %w", err)
+	}
+
+	response := map[string]interface{}{
+		"Updated": "OK",
+	}
+	blocked := warehouses[0].Availability && input.Availability != nil && !*input.Availability
+	if blocked && s.blockPolicy == models.BlockPolicyMove {
+		moved, kept, err := s.Storage.MoveWarehouseReservations(c.Request().Context(), id)
+		if err != nil {
+			return fmt.Errorf("Warehouse blocked, unable to move reservations: %w", err)
+		}
+		s.logger.Info("Server", slog.String("requestID", requestID),
+			slog.Int("warehouseID", id), slog.Int("moved", moved), slog.Int("kept", kept))
+		response["moved"] = moved
+		response["kept"] = kept
+	}
+
+	warehouses, _, err = s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{id}})
+	if err != nil || len(warehouses) == 0 {
+		s.logger.Error("Server", slog.String("requestID", requestID),
+			slog.String("error", fmt.Sprintf("Unable to get warehouse %d: %v", id, err)))
+		response["warehouse_id"] = id
+		return c.JSON(http.StatusOK, response)
+	}
+	response["warehouse"] = warehouses[0]
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// DeleteWarehouseHandler deletes an empty warehouse, warehouses with stock or reserves are a conflict
+func (s *Server) DeleteWarehouseHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid warehouse id")
+	}
+
+	err = s.Storage.DeleteWarehouse(c.Request().Context(), models.DeleteWarehouseInput{ID: id})
+	if err != nil {
+		return fmt.Errorf("Unable to delete warehouse: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Deleted": "OK",
+	})
+}
+
+// validateLength checks that a required string field is not blank and fits its column
+func validateLength(field string, value string, maxLength int) error {
+	if strings.TrimSpace(value) == "" {
+		return badRequest(fmt.Sprintf("%s is required", field))
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		return badRequest(fmt.Sprintf("%s can't be longer than %d characters", field, maxLength))
+	}
+	return nil
+}
+
+// GetProductsHandler returns a page of products filtered by id, code and style_id, all can be repeated, name, size and color
+func (s *Server) GetProductsHandler(c echo.Context) error {
+	var filter models.GetProductsFilter
+	var err error
+	if filter.Page, err = parsePage(c); err != nil {
+		return err
+	}
+	for _, value := range c.QueryParams()["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return badRequest("invalid id")
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+	filter.Codes = c.QueryParams()["code"]
+	for _, value := range c.QueryParams()["style_id"] {
+		styleID, err := strconv.Atoi(value)
+		if err != nil {
+			return badRequest("invalid style_id")
+		}
+		filter.StyleIDs = append(filter.StyleIDs, styleID)
+	}
+	filter.Name = c.QueryParam("name")
+	filter.Size = c.QueryParam("size")
+	filter.Color = c.QueryParam("color")
+
+	products, next, err := s.Storage.GetProducts(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get products: %w", err)
+	}
+	if products == nil {
+		products = []*models.Product{}
+	}
+
+	return c.JSON(http.StatusOK, pageResponse{Items: products, NextCursor: next})
+}
+
+func (s *Server) GetProductHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	products, _, err := s.Storage.GetProducts(c.Request().Context(), models.GetProductsFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get product: %w", err)
+	}
+	if len(products) == 0 {
+		return notFound(fmt.Sprintf("No product with ID: %d", id))
+	}
+
+	return c.JSON(http.StatusOK, products[0])
+}
+
+func (s *Server) GetProductByCodeHandler(c echo.Context) error {
+	code := c.Param("code")
+
+	products, _, err := s.Storage.GetProducts(c.Request().Context(), models.GetProductsFilter{Codes: []string{code}})
+	if err != nil {
+		return fmt.Errorf("Unable to get product: %w", err)
+	}
+	if len(products) == 0 {
+		return notFound(fmt.Sprintf("No product with code: %s", code))
+	}
+
+	return c.JSON(http.StatusOK, products[0])
+}
+
+// SearchProductsHandler finds products by a partial or mistyped name or code given by q, best matches first.
+// warehouse_id limits the search to products available in the warehouse
+func (s *Server) SearchProductsHandler(c echo.Context) error {
+	filter := models.SearchProductsFilter{Query: strings.TrimSpace(c.QueryParam("q"))}
+	if filter.Query == "" {
+		return badRequest("q is required")
+	}
+	var err error
+	if warehouseID := c.QueryParam("warehouse_id"); warehouseID != "" {
+		if filter.InStockWarehouseID, err = strconv.Atoi(warehouseID); err != nil {
+			return badRequest("invalid warehouse_id")
+		}
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 || filter.Limit > maxPageLimit {
+			return badRequest(fmt.Sprintf("limit must be from 1 to %d", maxPageLimit))
+		}
+	}
+
+	results, err := s.Storage.SearchProducts(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to search products: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// CreateProductHandler creates a product, a taken code is a conflict
+func (s *Server) CreateProductHandler(c echo.Context) error {
+	var productData ProductDTO
+	if err := c.Bind(&productData); err != nil {
+		return badRequest("invalid request body")
+	}
+	if productData.WarehouseID != nil && productData.Name == "" && productData.Code == "" {
+		return echo.NewHTTPError(http.StatusGone, fmt.Sprintf(
+			"POST /products no longer lists warehouse stock, use GET /api/v1/warehouses/%d/products", *productData.WarehouseID))
+	}
+
+	for _, field := range []struct {
+		name      string
+		value     string
+		maxLength int
+	}{
+		{"name", productData.Name, maxProductNameLength},
+		{"size", productData.Size, maxProductSizeLength},
+		{"code", productData.Code, maxProductCodeLength},
+	} {
+		if err := validateLength(field.name, field.value, field.maxLength); err != nil {
+			return err
+		}
+	}
+	if utf8.RuneCountInString(productData.Color) > maxProductColorLength {
+		return badRequest(fmt.Sprintf("color can't be longer than %d characters", maxProductColorLength))
+	}
+	if productData.StyleID != nil && *productData.StyleID <= 0 {
+		return badRequest("invalid style_id")
+	}
+	if productData.Unit == "" {
+		productData.Unit = units.BaseUnit
+	}
+	if err := validateLength("unit", productData.Unit, maxUnitLength); err != nil {
+		return err
+	}
+
+	product := models.Product{
+		Name:    productData.Name,
+		Size:    productData.Size,
+		Code:    productData.Code,
+		StyleID: productData.StyleID,
+		Color:   productData.Color,
+		Unit:    productData.Unit,
+	}
+	id, err := s.Storage.CreateProduct(c.Request().Context(), product)
+	if err != nil {
+		return fmt.Errorf("Unable to create product: %w", err)
+	}
+	product.ID = id
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Created": "OK",
+		"product": product,
+	})
+}
+
+// UpdateProductHandler changes the given fields of the product, a taken code is a conflict.
+// The unit of a product with stock can't be changed
+func (s *Server) UpdateProductHandler(c echo.Context) error {
+	requestID := c.Get("requestID").(string)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	var input models.UpdateProductInput
+	if err := c.Bind(&input); err != nil {
+		return badRequest("invalid request body")
+	}
+	input.ID = id
+
+	if input.Name == nil && input.Size == nil && input.Code == nil && input.StyleID == nil && input.Color == nil &&
+		input.Unit == nil && !input.ResetStyle {
+		return badRequest("Empty request")
+	}
+	if input.Color != nil && utf8.RuneCountInString(*input.Color) > maxProductColorLength {
+		return badRequest(fmt.Sprintf("color can't be longer than %d characters", maxProductColorLength))
+	}
+	if input.StyleID != nil && *input.StyleID <= 0 {
+		return badRequest("invalid style_id")
+	}
+	for _, field := range []struct {
+		name      string
+		value     *string
+		maxLength int
+	}{
+		{"name", input.Name, maxProductNameLength},
+		{"size", input.Size, maxProductSizeLength},
+		{"code", input.Code, maxProductCodeLength},
+		{"unit", input.Unit, maxUnitLength},
+	} {
+		if field.value == nil {
+			continue
+		}
+		if err := validateLength(field.name, *field.value, field.maxLength); err != nil {
+			return err
+		}
+	}
+
+	err = s.Storage.UpdateProduct(c.Request().Context(), &input)
+	if err != nil {
+		return fmt.Errorf("Unable to update product: %w", err)
+	}
+
+	products, _, err := s.Storage.GetProducts(c.Request().Context(), models.GetProductsFilter{IDs: []int{id}})
+	if err != nil || len(products) == 0 {
+		s.logger.Error("Server", slog.String("requestID", requestID),
+			slog.String("error", fmt.Sprintf("Unable to get product %d: %v", id, err)))
+		return c.JSON(http.StatusOK, map[string]interface{}{"Updated": "OK", "product_id": id})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"Updated": "OK", "product": products[0]})
+}
+
+// DeleteProductHandler deletes a product, products with stock or reserves are a conflict
+func (s *Server) DeleteProductHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	err = s.Storage.DeleteProduct(c.Request().Context(), models.DeleteProductInput{ID: id})
+	if err != nil {
+		return fmt.Errorf("Unable to delete product: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Deleted": "OK",
+	})
+}
+
+// validateLineProduct checks that a stock line gives its product by code or by a valid barcode
+// and has a proper quantity
+func validateLineProduct(code string, barcodeValue string, validQuantity bool) error {
+	if (code == "" && barcodeValue == "") || !validQuantity {
+		return badRequest("code or barcode and positive quantity are required")
+	}
+	if barcodeValue != "" && !barcode.Valid(barcodeValue) {
+		return badRequest(fmt.Sprintf("invalid barcode: %s", barcodeValue))
+	}
+
+	return nil
+}
+
+// validateLinePacks checks that a stock line gives its quantity either in base units or in packs
+func validateLinePacks(quantity int, pack string, packs json.Number) error {
+	if pack == "" && packs == "" {
+		return nil
+	}
+	if pack == "" || packs == "" {
+		return badRequest("pack and packs are required together")
+	}
+	if quantity != 0 {
+		return badRequest("quantity can't be given together with packs")
+	}
+
+	return nil
+}
+
+// convertPacks sets the quantities of stock lines given in packs in base units of their products.
+// Unknown products or packs are not found, fractional quantities of base units are rejected
+func (s *Server) convertPacks(ctx context.Context, lines []models.StockLine) error {
+	inPacks := false
+	for _, line := range lines {
+		if line.Pack != "" {
+			inPacks = true
+			break
+		}
+	}
+	if !inPacks {
+		return nil
+	}
+
+	failed, err := s.Storage.ConvertPacks(ctx, lines)
+	if err != nil {
+		return fmt.Errorf("Unable to convert packs: %w", err)
+	}
+	if len(failed) > 0 {
+		for _, line := range failed {
+			if line.Reason == models.ReasonNotFound {
+				return &storage.StockLinesError{Message: "Unknown products or packs", Reason: line.Reason, Failed: failed}
+			}
+		}
+		return &storage.StockLinesError{Message: "Packs are not a whole number of base units", Reason: failed[0].Reason, Failed: failed}
+	}
+
+	return nil
+}
+
+func (s *Server) GetProductPacksHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	packs, err := s.Storage.GetPacks(c.Request().Context(), id)
+	if err != nil {
+		return fmt.Errorf("Unable to get packs: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, packs)
+}
+
+// SetProductPackHandler creates a pack of the product or changes the number of base units it holds
+func (s *Server) SetProductPackHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	var packData PackDTO
+	if err := c.Bind(&packData); err != nil {
+		return badRequest("invalid request body")
+	}
+	if err := validateLength("name", packData.Name, maxUnitLength); err != nil {
+		return err
+	}
+	if packData.Quantity <= 0 {
+		return badRequest("quantity must be positive")
+	}
+
+	pack := models.ProductPack{ProductID: id, Name: packData.Name, Quantity: packData.Quantity}
+	err = s.Storage.SetPack(c.Request().Context(), pack)
+	if err != nil {
+		return fmt.Errorf("Unable to set pack: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Updated": "OK",
+		"pack":    pack,
+	})
+}
+
+func (s *Server) DeleteProductPackHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	err = s.Storage.DeletePack(c.Request().Context(), id, c.Param("name"))
+	if err != nil {
+		return fmt.Errorf("Unable to delete pack: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Deleted": "OK",
+	})
+}
+
+func (s *Server) GetProductBarcodesHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	barcodes, err := s.Storage.GetBarcodes(c.Request().Context(), models.GetBarcodesFilter{ProductIDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get barcodes: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, barcodes)
+}
+
+// AddProductBarcodesHandler assigns barcodes to the product, a barcode of another product is a conflict
+func (s *Server) AddProductBarcodesHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid product id")
+	}
+
+	var barcodesData BarcodesDTO
+	if err := c.Bind(&barcodesData); err != nil {
+		return badRequest("invalid request body")
+	}
+	if len(barcodesData.Barcodes) < 1 {
+		return badRequest("Empty request")
+	}
+	for _, value := range barcodesData.Barcodes {
+		if !barcode.Valid(value) {
+			return badRequest(fmt.Sprintf("invalid barcode: %s", value))
+		}
+	}
+
+	err = s.Storage.AddBarcodes(c.Request().Context(), id, barcodesData.Barcodes)
+	if err != nil {
+		return fmt.Errorf("Unable to add barcodes: %w", err)
+	}
+
+	barcodes, err := s.Storage.GetBarcodes(c.Request().Context(), models.GetBarcodesFilter{ProductIDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get barcodes: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Created":  "OK",
+		"barcodes": barcodes,
+	})
+}
+
+// GetBarcodeHandler resolves a scanned barcode to its product and the stock of the product in every warehouse
+func (s *Server) GetBarcodeHandler(c echo.Context) error {
+	value := c.Param("barcode")
+	if !barcode.Valid(value) {
+		return badRequest(fmt.Sprintf("invalid barcode: %s", value))
+	}
+
+	barcodes, err := s.Storage.GetBarcodes(c.Request().Context(), models.GetBarcodesFilter{Barcodes: []string{value}})
+	if err != nil {
+		return fmt.Errorf("Unable to get barcode: %w", err)
+	}
+	if len(barcodes) == 0 {
+		return notFound(fmt.Sprintf("No product with barcode: %s", value))
+	}
+
+	productID := barcodes[0].ProductID
+	products, _, err := s.Storage.GetProducts(c.Request().Context(), models.GetProductsFilter{IDs: []int{productID}})
+	if err != nil {
+		return fmt.Errorf("Unable to get product: %w", err)
+	}
+	if len(products) == 0 {
+		return notFound(fmt.Sprintf("No product with barcode: %s", value))
+	}
+
+	stocks, _, err := s.Storage.GetWP(c.Request().Context(), models.GetWarehouseProductFilter{ProductID: productID})
+	if err != nil {
+		return fmt.Errorf("Unable to get stocks: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"barcode": value,
+		"product": products[0],
+		"stocks":  stocks,
+	})
+}
+
+func (s *Server) DeleteBarcodeHandler(c echo.Context) error {
+	err := s.Storage.DeleteBarcode(c.Request().Context(), c.Param("barcode"))
+	if err != nil {
+		return fmt.Errorf("Unable to delete barcode: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Deleted": "OK",
+	})
+}
+
+// GetStylesHandler returns a page of styles filtered by id and article, both can be repeated, and name
+func (s *Server) GetStylesHandler(c echo.Context) error {
+	var filter models.GetStylesFilter
+	var err error
+	if filter.Page, err = parsePage(c); err != nil {
+		return err
+	}
+	for _, value := range c.QueryParams()["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return badRequest("invalid id")
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+	filter.Articles = c.QueryParams()["article"]
+	filter.Name = c.QueryParam("name")
+
+	styles, next, err := s.Storage.GetStyles(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get styles: %w", err)
+	}
+	if styles == nil {
+		styles = []*models.Style{}
+	}
+
+	return c.JSON(http.StatusOK, pageResponse{Items: styles, NextCursor: next})
+}
+
+// GetStyleHandler returns the style with its variants
+func (s *Server) GetStyleHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid style id")
+	}
+
+	styles, _, err := s.Storage.GetStyles(c.Request().Context(), models.GetStylesFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get style: %w", err)
+	}
+	if len(styles) == 0 {
+		return notFound(fmt.Sprintf("No style with ID: %d", id))
+	}
+
+	styles[0].Variants, _, err = s.Storage.GetProducts(c.Request().Context(), models.GetProductsFilter{StyleIDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get style variants: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, styles[0])
+}
+
+// CreateStyleHandler creates a style without variants, a taken article is a conflict
+func (s *Server) CreateStyleHandler(c echo.Context) error {
+	var styleData StyleDTO
+	if err := c.Bind(&styleData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if err := validateLength("article", styleData.Article, maxStyleArticleLength); err != nil {
+		return err
+	}
+	if err := validateLength("name", styleData.Name, maxStyleNameLength); err != nil {
+		return err
+	}
+	if utf8.RuneCountInString(styleData.SizeGrid) > maxStyleSizeGridLength {
+		return badRequest(fmt.Sprintf("size_grid can't be longer than %d characters", maxStyleSizeGridLength))
+	}
+
+	style := models.Style{Article: styleData.Article, Name: styleData.Name, SizeGrid: styleData.SizeGrid}
+	id, err := s.Storage.CreateStyle(c.Request().Context(), style)
+	if err != nil {
+		return fmt.Errorf("Unable to create style: %w", err)
+	}
+	style.ID = id
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Created": "OK",
+		"style":   style,
+	})
+}
+
+func (s *Server) UpdateStyleHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid style id")
+	}
+
+	var input models.UpdateStyleInput
+	if err := c.Bind(&input); err != nil {
+		return badRequest("invalid request body")
+	}
+	input.ID = id
+
+	if input.Article == nil && input.Name == nil && input.SizeGrid == nil {
+		return badRequest("Empty request")
+	}
+	if input.Article != nil {
+		if err := validateLength("article", *input.Article, maxStyleArticleLength); err != nil {
+			return err
+		}
+	}
+	if input.Name != nil {
+		if err := validateLength("name", *input.Name, maxStyleNameLength); err != nil {
+			return err
+		}
+	}
+	if input.SizeGrid != nil && utf8.RuneCountInString(*input.SizeGrid) > maxStyleSizeGridLength {
+		return badRequest(fmt.Sprintf("size_grid can't be longer than %d characters", maxStyleSizeGridLength))
+	}
+
+	err = s.Storage.UpdateStyle(c.Request().Context(), &input)
+	if err != nil {
+		return fmt.Errorf("Unable to update style: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Updated": "OK",
+	})
+}
+
+// DeleteStyleHandler deletes a style, styles with variants are a conflict
+func (s *Server) DeleteStyleHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid style id")
+	}
+
+	err = s.Storage.DeleteStyle(c.Request().Context(), models.DeleteStyleInput{ID: id})
+	if err != nil {
+		return fmt.Errorf("Unable to delete style: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Deleted": "OK",
+	})
+}
+
+// GetStyleStockHandler rolls up the stock of variants per style and warehouse, filtered by style_id, can be repeated,
+// and warehouse_id
+func (s *Server) GetStyleStockHandler(c echo.Context) error {
+	var filter models.GetStyleStockFilter
+	var err error
+	for _, value := range c.QueryParams()["style_id"] {
+		styleID, err := strconv.Atoi(value)
+		if err != nil {
+			return badRequest("invalid style_id")
+		}
+		filter.StyleIDs = append(filter.StyleIDs, styleID)
+	}
+	if warehouseID := c.QueryParam("warehouse_id"); warehouseID != "" {
+		if filter.WarehouseID, err = strconv.Atoi(warehouseID); err != nil {
+			return badRequest("invalid warehouse_id")
+		}
+	}
+
+	stocks, err := s.Storage.GetStyleStock(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get style stock: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, stocks)
+}
+
+// GetStocksHandler returns a page of stock lines filtered by id, warehouse_id, product_id,
+// min_available and availability of the warehouse
+func (s *Server) GetStocksHandler(c echo.Context) error {
+	filter, err := parseStocksFilter(c)
+	if err != nil {
+		return err
+	}
+	for _, value := range c.QueryParams()["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return badRequest("invalid id")
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+	if warehouseID := c.QueryParam("warehouse_id"); warehouseID != "" {
+		if filter.WarehouseID, err = strconv.Atoi(warehouseID); err != nil {
+			return badRequest("invalid warehouse_id")
+		}
+	}
+	if productID := c.QueryParam("product_id"); productID != "" {
+		if filter.ProductID, err = strconv.Atoi(productID); err != nil {
+			return badRequest("invalid product_id")
+		}
+	}
+
+	stocks, next, err := s.Storage.GetWP(c.Request().Context(), filter)
+	if err != nil {
+		return fmt.Errorf("Unable to get stocks: %w", err)
+	}
+	if stocks == nil {
+		stocks = []*models.WarehouseProduct{}
+	}
+
+	return c.JSON(http.StatusOK, pageResponse{Items: stocks, NextCursor: next})
+}
+
+func (s *Server) GetStockHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stock id")
+	}
+
+	stocks, _, err := s.Storage.GetWP(c.Request().Context(), models.GetWarehouseProductFilter{IDs: []int{id}})
+	if err != nil {
+		return fmt.Errorf("Unable to get stock: %w", err)
+	}
+	if len(stocks) == 0 {
+		return notFound(fmt.Sprintf("No stock with ID: %d", id))
+	}
+
+	return c.JSON(http.StatusOK, stocks[0])
+}
+
+// CreateStockHandler places a product into a warehouse with an initial quantity, a product already in the warehouse is a conflict
+func (s *Server) CreateStockHandler(c echo.Context) error {
+	requestID := c.Get("requestID").(string)
+	var stockData StockDTO
+	if err := c.Bind(&stockData); err != nil {
+		return badRequest("invalid request body")
+	}
+
+	if stockData.WarehouseID <= 0 {
+		return badRequest("warehouse_id is required")
+	}
+	if stockData.ProductID <= 0 && stockData.Code == "" {
+		return badRequest("product_id or code is required")
+	}
+	if stockData.Quantity < 0 || stockData.MinLevel < 0 || stockData.ReorderPoint < 0 {
+		return badRequest("quantity, min_level and reorder_point can't be negative")
+	}
+	if stockData.SafetyStock != nil && *stockData.SafetyStock < 0 {
+		return badRequest("safety_stock can't be negative")
+	}
+
+	warehouses, _, err := s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{stockData.WarehouseID}})
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse: %w", err)
+	}
+	if len(warehouses) == 0 {
+		return notFound(fmt.Sprintf("No warehouse with ID: %d", stockData.WarehouseID))
+	}
+
+	productFilter := models.GetProductsFilter{IDs: []int{stockData.ProductID}}
+	if stockData.ProductID <= 0 {
+		productFilter = models.GetProductsFilter{Codes: []string{stockData.Code}}
+	}
+	products, _, err := s.Storage.GetProducts(c.Request().Context(), productFilter)
+	if err != nil {
+		return fmt.Errorf("Unable to get product: %w", err)
+	}
+	if len(products) == 0 || (stockData.Code != "" && products[0].Code != stockData.Code) {
+		return notFound("No such product")
+	}
+
+	id, err := s.Storage.CreateWP(c.Request().Context(), models.WarehouseProduct{
+		WarehouseID:  stockData.WarehouseID,
+		ProductID:    products[0].ID,
+		Quantity:     stockData.Quantity,
+		MinLevel:     stockData.MinLevel,
+		ReorderPoint: stockData.ReorderPoint,
+		SafetyStock:  stockData.SafetyStock,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to create stock: %w", err)
+	}
+
+	return s.stockResponse(c, requestID, "Created", id)
+}
+
+// UpdateStockHandler changes quantity, thresholds and safety stock of a stock line.
+// Quantity can't drop below the reserved quantity, reserves are changed only by reservations
+func (s *Server) UpdateStockHandler(c echo.Context) error {
+	requestID := c.Get("requestID").(string)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stock id")
+	}
+
+	var input models.UpdateWarehouseProductInput
+	if err := c.Bind(&input); err != nil {
+		return badRequest("invalid request body")
+	}
+	input.ID = id
+
+	if input.WarehouseID != nil || input.ProductID != nil || input.ReservedQuantity != nil {
+		return badRequest("warehouse_id, product_id and reserved_quantity can't be changed")
+	}
+	if input.Quantity == nil && input.MinLevel == nil && input.ReorderPoint == nil && input.SafetyStock == nil && !input.ResetSafetyStock {
+		return badRequest("Empty request")
+	}
+	for _, value := range []*int{input.Quantity, input.MinLevel, input.ReorderPoint, input.SafetyStock} {
+		if value != nil && *value < 0 {
+			return badRequest("quantity, min_level, reorder_point and safety_stock can't be negative")
+		}
+	}
+
+	err = s.Storage.UpdateWP(c.Request().Context(), &input)
+	if err != nil {
+		return fmt.Errorf("Unable to update stock: %w", err)
+	}
+
+	return s.stockResponse(c, requestID, "Updated", id)
+}
+
+func (s *Server) DeleteStockHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest("invalid stock id")
+	}
+
+	return s.deleteStocks(c, models.DeleteWarehouseProductInput{IDs: []int{id}})
+}
+
+// DeleteStocksHandler removes the stock lines matching every given filter: id, warehouse_id and product_id, all can be repeated
+func (s *Server) DeleteStocksHandler(c echo.Context) error {
+	var input models.DeleteWarehouseProductInput
+	for name, ids := range map[string]*[]int{"id": &input.IDs, "warehouse_id": &input.WarehouseID, "product_id": &input.ProductID} {
+		for _, value := range c.QueryParams()[name] {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return badRequest(fmt.Sprintf("invalid %s", name))
+			}
+			*ids = append(*ids, id)
+		}
+	}
+	if len(input.IDs) == 0 && len(input.WarehouseID) == 0 && len(input.ProductID) == 0 {
+		return badRequest("id, warehouse_id or product_id is required")
+	}
+
+	return s.deleteStocks(c, input)
+}
+
+func (s *Server) deleteStocks(c echo.Context, input models.DeleteWarehouseProductInput) error {
+	err := s.Storage.DeleteWP(c.Request().Context(), input)
+	if err != nil {
+		return fmt.Errorf("Unable to delete stock: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Deleted": "OK",
+	})
+}
+
+func (s *Server) stockResponse(c echo.Context, requestID string, done string, id int) error {
+	stocks, _, err := s.Storage.GetWP(c.Request().Context(), models.GetWarehouseProductFilter{IDs: []int{id}})
+	if err != nil || len(stocks) == 0 {
+		s.logger.Error("Server", slog.String("requestID", requestID),
+			slog.String("error", fmt.Sprintf("Unable to get stock %d: %v", id, err)))
+		return c.JSON(http.StatusOK, map[string]interface{}{done: "OK", "stock_id": id})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{done: "OK", "stock": stocks[0]})
+}
+
+func (s *Server) BlockWarehouseHandler(c echo.Context) error {
+	requestID := c.Get("requestID").(string)
+	False := false
+	var warehouse BlockWarehouseDTO
+	if err := c.Bind(&warehouse); err != nil {
+		return badRequest("invalid request body")
+	}
+	wps, _, err := s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{warehouse.WarehouseID}})
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse: %w", err)
+	}
+	if wps == nil {
+		return notFound(fmt.Sprintf("No warehouse with ID: %d", warehouse.WarehouseID))
+	}
+	err = s.Storage.UpdateWarehouse(c.Request().Context(), &models.UpdateWarehouseInput{ID: wps[0].ID, Name: &wps[0].Name, Availability: &False})
+	if err != nil {
+		return fmt.Errorf("Unable to update warehouse: %w", err)
+	}
+
+	if s.blockPolicy != models.BlockPolicyMove {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"Blocked": "OK",
+		})
+	}
+
+	moved, kept, err := s.Storage.MoveWarehouseReservations(c.Request().Context(), wps[0].ID)
+	if err != nil {
+		return fmt.Errorf("Warehouse blocked, unable to move reservations: %w", err)
+	}
+	s.logger.Info("Server", slog.String("requestID", requestID),
+		slog.Int("warehouseID", wps[0].ID), slog.Int("moved", moved), slog.Int("kept", kept))
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Blocked": "OK",
+		"moved":   moved,
+		"kept":    kept,
+	})
+}
+
+func (s *Server) UnblockWarehouseHandler(c echo.Context) error {
+	True := true
+	var warehouse BlockWarehouseDTO
+	if err := c.Bind(&warehouse); err != nil {
+		return badRequest("invalid request body")
+	}
+	wps, _, err := s.Storage.GetWarehouses(c.Request().Context(), models.GetWarehousesFilter{IDs: []int{warehouse.WarehouseID}})
+	if err != nil {
+		return fmt.Errorf("Unable to get warehouse: %w", err)
+	}
+	if wps == nil {
+		return notFound(fmt.Sprintf("No warehouse with ID: %d", warehouse.WarehouseID))
+	}
+	err = s.Storage.UpdateWarehouse(c.Request().Context(), &models.UpdateWarehouseInput{ID: wps[0].ID, Name: &wps[0].Name, Availability: &True})
+	if err != nil {
+		return fmt.Errorf("Unable to update warehouse: %w", err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"Unblocked": "OK",
+	})
+}
+
+// StatusHandler reports the counters of the background workers
+func (s *Server) StatusHandler(c echo.Context) error {
+	var expired int64
+	if s.expiry != nil {
+		expired = s.expiry.Expired()
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"reservations_expired": expired,
 	})
 }
 
 func (s *Server) NotFound(c echo.Context) error {
-	return c.JSON(http.StatusNotFound, "Page not found")
+	return notFound("Page not found")
 }
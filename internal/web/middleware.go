@@ -1,20 +1,57 @@
 package web
 
 import (
+	"LamodaTest/internal/config"
+	"LamodaTest/internal/models"
+	"LamodaTest/internal/storage"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/google/uuid"
 	"github.com/labstack/echo"
+	"io"
 	"log/slog"
+	"net/http"
 	"strconv"
 	"time"
 )
 
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotencyReplayHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+
+	defaultIdempotencyTTL               = 24 * time.Hour
+	defaultIdempotencyInProgressTimeout = 5 * time.Minute
+
+	actorHeader  = "X-Actor"
+	defaultActor = "api"
+)
+
 type Middleware struct {
-	logger *slog.Logger
+	logger            *slog.Logger
+	storage           storage.IdempotencyStorage
+	idempotencyTTL    time.Duration
+	inProgressTimeout time.Duration
 }
 
-func NewMiddleware(logger *slog.Logger) *Middleware {
+func NewMiddleware(cfg config.Idempotency, logger *slog.Logger, storage storage.IdempotencyStorage) *Middleware {
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	inProgressTimeout := cfg.InProgressTimeout
+	if inProgressTimeout <= 0 {
+		inProgressTimeout = defaultIdempotencyInProgressTimeout
+	}
+
 	return &Middleware{
-		logger: logger,
+		logger:            logger,
+		storage:           storage,
+		idempotencyTTL:    ttl,
+		inProgressTimeout: inProgressTimeout,
 	}
 }
 
@@ -30,6 +67,12 @@ func (m *Middleware) AccessLog() echo.MiddlewareFunc {
 			requestID := uuid.New().String()
 			c.Set("requestID", requestID)
 
+			actor := c.Request().Header.Get(actorHeader)
+			if actor == "" {
+				actor = defaultActor
+			}
+			c.SetRequest(c.Request().WithContext(storage.WithMovementSource(c.Request().Context(), actor, requestID)))
+
 			m.logger.Info("Request started",
 				slog.String("RequestID", requestID),
 				slog.String("IP", c.RealIP()),
@@ -38,22 +81,148 @@ func (m *Middleware) AccessLog() echo.MiddlewareFunc {
 			)
 
 			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
 
 			responseTime := time.Since(startTime)
+			attrs := []any{
+				slog.String("RequestID", requestID),
+				slog.String("Time spent", strconv.FormatInt(int64(responseTime), 10)),
+				slog.Int("Status", c.Response().Status),
+			}
 			if err != nil {
-				m.logger.Error("Request Failed",
-					slog.String("RequestID", requestID),
-					slog.String("Time spent", strconv.FormatInt(int64(responseTime), 10)),
-					slog.String("Error", err.Error()),
-				)
-			} else {
-				m.logger.Info("Request done",
-					slog.String("RequestID", requestID),
-					slog.String("Time spent", strconv.FormatInt(int64(responseTime), 10)),
-				)
-			}
-
-			return err
+				attrs = append(attrs, slog.String("Error", err.Error()))
+			}
+			switch {
+			case c.Response().Status >= http.StatusInternalServerError:
+				m.logger.Error("Request Failed", attrs...)
+			case err != nil || c.Response().Status >= http.StatusBadRequest:
+				m.logger.Info("Request Failed", attrs...)
+			default:
+				m.logger.Info("Request done", attrs...)
+			}
+
+			return nil
 		}
 	}
 }
+
+// Idempotency replays the stored response for a repeated Idempotency-Key
+// and rejects reuse of the key with a different request
+func (m *Middleware) Idempotency() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return badRequest("Idempotency-Key is too long")
+			}
+
+			requestID := c.Get("requestID").(string)
+			ctx := c.Request().Context()
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return badRequest("invalid request body")
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+			hash := sha256.New()
+			hash.Write([]byte(c.Request().Method + " " + c.Request().URL.Path + "\n"))
+			hash.Write(body)
+			requestHash := hex.EncodeToString(hash.Sum(nil))
+
+			created, err := m.storage.CreateIdempotencyKey(ctx, models.IdempotencyKey{Key: key, Owner: requestID, RequestHash: requestHash},
+				m.inProgressTimeout, m.idempotencyTTL)
+			if err != nil {
+				m.logger.Error("Server", slog.String("requestID", requestID),
+					slog.String("error", "Unable to store idempotency key: "+err.Error()))
+				return echo.NewHTTPError(http.StatusInternalServerError, "Unable to store idempotency key")
+			}
+
+			if !created {
+				stored, err := m.storage.GetIdempotencyKey(ctx, key)
+				if err != nil {
+					m.logger.Error("Server", slog.String("requestID", requestID),
+						slog.String("error", "Unable to get idempotency key: "+err.Error()))
+					return echo.NewHTTPError(http.StatusInternalServerError, "Unable to get idempotency key")
+				}
+				if stored != nil && stored.RequestHash != requestHash {
+					return echo.NewHTTPError(http.StatusUnprocessableEntity, "Idempotency-Key is already used for a different request")
+				}
+				if stored == nil || stored.StatusCode == 0 {
+					return echo.NewHTTPError(http.StatusConflict, "Request with this Idempotency-Key is in progress")
+				}
+
+				m.logger.Info("Server", slog.String("requestID", requestID),
+					slog.String("idempotencyKey", key), slog.String("info", "Replayed stored response"))
+				c.Response().Header().Set(idempotencyReplayHeader, "true")
+				return c.JSONBlob(stored.StatusCode, stored.Response)
+			}
+
+			// The key is released or completed even if the client goes away in the meantime
+			ctx = context.WithoutCancel(ctx)
+
+			// A panic is recovered by the Recover middleware outside, the key is released so the request can be retried
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					m.deleteIdempotencyKey(ctx, requestID, key)
+					panic(recovered)
+				}
+			}()
+
+			recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+
+			// Errors are written here so that their responses are stored as well
+			err = next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			if status >= http.StatusInternalServerError {
+				m.deleteIdempotencyKey(ctx, requestID, key)
+				return nil
+			}
+
+			updateErr := m.storage.UpdateIdempotencyKey(ctx, &models.UpdateIdempotencyKeyInput{
+				Key: key, Owner: requestID, StatusCode: status, Response: recorder.body.Bytes(),
+			})
+			if errors.Is(updateErr, storage.ErrConflict) {
+				m.logger.Info("Server", slog.String("requestID", requestID),
+					slog.String("idempotencyKey", key), slog.String("info", "Key was taken over, response is not stored"))
+			} else if updateErr != nil {
+				m.logger.Error("Server", slog.String("requestID", requestID),
+					slog.String("error", "Unable to store idempotent response: "+updateErr.Error()))
+			}
+
+			return nil
+		}
+	}
+}
+
+func (m *Middleware) deleteIdempotencyKey(ctx context.Context, requestID string, key string) {
+	err := m.storage.DeleteIdempotencyKey(ctx, key, requestID)
+	if errors.Is(err, storage.ErrConflict) {
+		m.logger.Info("Server", slog.String("requestID", requestID),
+			slog.String("idempotencyKey", key), slog.String("info", "Key was taken over, it is not deleted"))
+	} else if err != nil {
+		m.logger.Error("Server", slog.String("requestID", requestID),
+			slog.String("error", "Unable to delete idempotency key: "+err.Error()))
+	}
+}
+
+// responseRecorder copies the response body while writing it to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -2,43 +2,64 @@ package web
 
 import (
 	"LamodaTest/internal/config"
+	"LamodaTest/internal/models"
 	"LamodaTest/internal/storage"
 	"fmt"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"io"
 	"log/slog"
+	"time"
 )
 
 type Server struct {
-	app     *echo.Echo
-	URL     string
-	logger  *slog.Logger
-	Storage *storage.Storage
+	app            *echo.Echo
+	URL            string
+	logger         *slog.Logger
+	Storage        *storage.Storage
+	middleware     *Middleware
+	reservationTTL time.Duration
+	blockPolicy    models.BlockPolicy
+	expiry         ExpiryStats
 }
 
-func New(srvCfg config.Server, logger *slog.Logger, storage *storage.Storage) (*Server, error) {
+// ExpiryStats reports how many reservations the expiry sweeper has expired since the start
+type ExpiryStats interface {
+	Expired() int64
+}
+
+func New(srvCfg config.Server, resCfg config.Reservation, idemCfg config.Idempotency, blockPolicy models.BlockPolicy, logger *slog.Logger,
+	storage *storage.Storage) (*Server, error) {
 	e := echo.New()
 	server := Server{
-		app:     e,
-		URL:     srvCfg.URL,
-		logger:  logger,
-		Storage: storage,
+		app:            e,
+		URL:            srvCfg.URL,
+		logger:         logger,
+		Storage:        storage,
+		reservationTTL: resCfg.DefaultTTL,
+		blockPolicy:    blockPolicy,
 	}
 	e.HideBanner = true
 	e.Logger.SetOutput(io.Discard)
+	e.HTTPErrorHandler = server.HTTPErrorHandler
 
 	e.Use(middleware.Recover())
 	e.Use(middleware.Secure())
 	e.Use(middleware.CORS())
 
-	m := NewMiddleware(logger)
+	m := NewMiddleware(idemCfg, logger, storage)
 	m.Register(e)
+	server.middleware = m
 	server.RegisterHandlers()
 
 	return &server, nil
 }
 
+// SetExpiryStats makes the status endpoint report the counters of the expiry sweeper
+func (s *Server) SetExpiryStats(stats ExpiryStats) {
+	s.expiry = stats
+}
+
 func (s *Server) Serve() error {
 	s.logger.Info("HTTP server started", slog.String("url", s.URL))
 
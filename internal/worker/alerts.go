@@ -0,0 +1,151 @@
+package worker
+
+import (
+	"LamodaTest/internal/config"
+	"LamodaTest/internal/models"
+	"LamodaTest/internal/storage"
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultAlertsInterval = 30 * time.Second
+
+	// alertsBatchDelay collects stock changes arriving together into one evaluation
+	alertsBatchDelay = 100 * time.Millisecond
+	alertsBatchSize  = 1000
+)
+
+// StockAlertEvaluator compares available stock with the low-stock thresholds, records alerts and logs them.
+// Stock changes announced on the stock_changed channel are evaluated right after their commit,
+// every warehouse product is also evaluated periodically in case notifications were lost
+type StockAlertEvaluator struct {
+	storage       storage.AlertStorage
+	logger        *slog.Logger
+	interval      time.Duration
+	notifications <-chan *pq.Notification
+}
+
+// NewStockAlertEvaluator creates the evaluator, with nil notifications stock is only evaluated periodically
+func NewStockAlertEvaluator(cfg config.Alerts, logger *slog.Logger, storage storage.AlertStorage,
+	notifications <-chan *pq.Notification) *StockAlertEvaluator {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultAlertsInterval
+	}
+
+	return &StockAlertEvaluator{
+		storage:       storage,
+		logger:        logger,
+		interval:      interval,
+		notifications: notifications,
+	}
+}
+
+// Run evaluates stock alerts until ctx is cancelled
+func (e *StockAlertEvaluator) Run(ctx context.Context) {
+	e.logger.Info("Stock alert evaluator started", slog.String("interval", e.interval.String()))
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.logger.Info("Stock alert evaluator stopped")
+			return
+		case <-ticker.C:
+			e.evaluate(ctx, nil)
+		case notification := <-e.notifications:
+			// After a reconnect of the listener every warehouse product is evaluated
+			keys, complete := e.collect(ctx, notification)
+			if !complete {
+				keys = nil
+			}
+			e.evaluate(ctx, keys)
+		}
+	}
+}
+
+// collect gathers the stock changed by the notification and the ones following it within alertsBatchDelay.
+// It reports false after a reconnect of the listener, when changes may have been missed
+func (e *StockAlertEvaluator) collect(ctx context.Context, notification *pq.Notification) ([]models.StockKey, bool) {
+	seen := make(map[models.StockKey]bool)
+	var keys []models.StockKey
+
+	timer := time.NewTimer(alertsBatchDelay)
+	defer timer.Stop()
+
+	for {
+		if notification == nil {
+			return nil, false
+		}
+		if key, ok := parseStockKey(notification.Extra); !ok {
+			e.logger.Error("Invalid stock change notification", slog.String("payload", notification.Extra))
+		} else if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+		if len(keys) >= alertsBatchSize {
+			return keys, true
+		}
+
+		select {
+		case notification = <-e.notifications:
+		case <-timer.C:
+			return keys, true
+		case <-ctx.Done():
+			return keys, true
+		}
+	}
+}
+
+// parseStockKey parses the "warehouse_id:product_id" payload of a stock_changed notification
+func parseStockKey(payload string) (models.StockKey, bool) {
+	warehouseID, productID, found := strings.Cut(payload, ":")
+	if !found {
+		return models.StockKey{}, false
+	}
+
+	var key models.StockKey
+	var err error
+	if key.WarehouseID, err = strconv.Atoi(warehouseID); err != nil {
+		return models.StockKey{}, false
+	}
+	if key.ProductID, err = strconv.Atoi(productID); err != nil {
+		return models.StockKey{}, false
+	}
+
+	return key, true
+}
+
+// evaluate evaluates alerts of the given stock, of every warehouse product without keys
+func (e *StockAlertEvaluator) evaluate(ctx context.Context, keys []models.StockKey) {
+	raised, resolved, err := e.storage.EvaluateStockAlerts(ctx, keys)
+	if err != nil {
+		e.logger.Error("Unable to evaluate stock alerts", slog.String("error", err.Error()))
+		return
+	}
+
+	for _, alert := range raised {
+		e.logger.Warn("Low stock",
+			slog.Int("warehouse_id", alert.WarehouseID),
+			slog.Int("product_id", alert.ProductID),
+			slog.String("level", string(alert.Level)),
+			slog.Int("available", alert.Available),
+			slog.Int("threshold", alert.Threshold),
+		)
+	}
+	for _, alert := range resolved {
+		e.logger.Info("Low stock resolved",
+			slog.Int("warehouse_id", alert.WarehouseID),
+			slog.Int("product_id", alert.ProductID),
+			slog.String("level", string(alert.Level)),
+		)
+	}
+}
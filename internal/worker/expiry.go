@@ -0,0 +1,85 @@
+package worker
+
+import (
+	"LamodaTest/internal/config"
+	"LamodaTest/internal/storage"
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSweepInterval  = time.Minute
+	defaultSweepBatchSize = 100
+
+	expiryActor = "expiry_sweeper"
+)
+
+// ExpirySweeper periodically releases reservations whose TTL has passed
+type ExpirySweeper struct {
+	storage   storage.ReservationStorage
+	logger    *slog.Logger
+	interval  time.Duration
+	batchSize int
+	expired   atomic.Int64
+}
+
+func NewExpirySweeper(cfg config.Reservation, logger *slog.Logger, storage storage.ReservationStorage) *ExpirySweeper {
+	interval := cfg.SweepInterval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	batchSize := cfg.SweepBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSweepBatchSize
+	}
+
+	return &ExpirySweeper{
+		storage:   storage,
+		logger:    logger,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run sweeps expired reservations until ctx is cancelled
+func (s *ExpirySweeper) Run(ctx context.Context) {
+	s.logger.Info("Reservation expiry sweeper started", slog.String("interval", s.interval.String()))
+	ctx = storage.WithMovementSource(ctx, expiryActor, "")
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Reservation expiry sweeper stopped", slog.Int64("expired", s.Expired()))
+			return
+		case <-ticker.C:
+			s.sweep(ctx)
+		}
+	}
+}
+
+// Expired returns how many reservations were expired since the sweeper started
+func (s *ExpirySweeper) Expired() int64 {
+	return s.expired.Load()
+}
+
+func (s *ExpirySweeper) sweep(ctx context.Context) {
+	for {
+		count, err := s.storage.ExpireReservations(ctx, s.batchSize)
+		total := s.expired.Add(int64(count))
+		if count > 0 {
+			s.logger.Info("Reservations expired", slog.Int("count", count), slog.Int64("total", total))
+		}
+		if err != nil {
+			s.logger.Error("Unable to expire reservations", slog.String("error", err.Error()))
+			return
+		}
+		if count < s.batchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"LamodaTest/internal/config"
+	"LamodaTest/internal/storage"
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultIdempotencyCleanupInterval = time.Hour
+	defaultIdempotencyTTL             = 24 * time.Hour
+)
+
+// IdempotencyCleaner periodically deletes idempotency keys with their stored responses once their TTL has passed
+type IdempotencyCleaner struct {
+	storage  storage.IdempotencyStorage
+	logger   *slog.Logger
+	interval time.Duration
+	ttl      time.Duration
+}
+
+func NewIdempotencyCleaner(cfg config.Idempotency, logger *slog.Logger, storage storage.IdempotencyStorage) *IdempotencyCleaner {
+	interval := cfg.CleanupInterval
+	if interval <= 0 {
+		interval = defaultIdempotencyCleanupInterval
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	return &IdempotencyCleaner{
+		storage:  storage,
+		logger:   logger,
+		interval: interval,
+		ttl:      ttl,
+	}
+}
+
+// Run deletes expired idempotency keys until ctx is cancelled
+func (c *IdempotencyCleaner) Run(ctx context.Context) {
+	c.logger.Info("Idempotency key cleaner started", slog.String("interval", c.interval.String()))
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.logger.Info("Idempotency key cleaner stopped")
+			return
+		case <-ticker.C:
+			c.cleanup(ctx)
+		}
+	}
+}
+
+func (c *IdempotencyCleaner) cleanup(ctx context.Context) {
+	count, err := c.storage.DeleteExpiredIdempotencyKeys(ctx, c.ttl)
+	if err != nil {
+		c.logger.Error("Unable to delete expired idempotency keys", slog.String("error", err.Error()))
+		return
+	}
+	if count > 0 {
+		c.logger.Info("Expired idempotency keys deleted", slog.Int("count", count))
+	}
+}
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"LamodaTest/internal/config"
+	"LamodaTest/internal/storage"
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultSnapshotInterval = time.Hour
+	defaultSnapshotDelay    = time.Hour
+)
+
+// StockSnapshotter materialises daily stock snapshots so that point-in-time
+// queries only replay the movements of a single day
+type StockSnapshotter struct {
+	storage  storage.MovementStorage
+	logger   *slog.Logger
+	interval time.Duration
+	delay    time.Duration
+}
+
+func NewStockSnapshotter(cfg config.Snapshot, logger *slog.Logger, storage storage.MovementStorage) *StockSnapshotter {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	delay := cfg.Delay
+	if delay <= 0 {
+		delay = defaultSnapshotDelay
+	}
+
+	return &StockSnapshotter{
+		storage:  storage,
+		logger:   logger,
+		interval: interval,
+		delay:    delay,
+	}
+}
+
+// Run takes missing snapshots until ctx is cancelled
+func (s *StockSnapshotter) Run(ctx context.Context) {
+	s.logger.Info("Stock snapshotter started", slog.String("interval", s.interval.String()))
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	s.snapshot(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Stock snapshotter stopped")
+			return
+		case <-ticker.C:
+			s.snapshot(ctx)
+		}
+	}
+}
+
+func (s *StockSnapshotter) snapshot(ctx context.Context) {
+	at, count, err := s.storage.CreateStockSnapshot(ctx, s.delay)
+	if err != nil {
+		s.logger.Error("Unable to create stock snapshot", slog.String("error", err.Error()))
+		return
+	}
+	if count > 0 {
+		s.logger.Info("Stock snapshot created", slog.String("at", at.Format(time.DateOnly)), slog.Int("rows", count))
+	}
+}
@@ -0,0 +1,22 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS reservations (
+                                            id SERIAL PRIMARY KEY,
+                                            order_ref VARCHAR(255) NOT NULL DEFAULT '',
+                                            status VARCHAR(20) NOT NULL DEFAULT 'active',
+                                            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+                                            updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE TABLE IF NOT EXISTS reservation_lines (
+                                                 id SERIAL PRIMARY KEY,
+                                                 reservation_id INT NOT NULL REFERENCES reservations(id) ON DELETE CASCADE,
+                                                 warehouse_id INT REFERENCES warehouses(id) ON DELETE CASCADE,
+                                                 product_id INT REFERENCES products(id) ON DELETE CASCADE,
+                                                 quantity INT NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS reservations_order_ref_idx ON reservations (order_ref);
+CREATE INDEX IF NOT EXISTS reservation_lines_reservation_id_idx ON reservation_lines (reservation_id);
+
+COMMIT;
@@ -0,0 +1,2 @@
+ALTER TABLE warehouse_product
+    ADD CONSTRAINT warehouse_product_quantity_check CHECK (quantity >= 0 AND reserved_quantity >= 0);
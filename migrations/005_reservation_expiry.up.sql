@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE reservations ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS reservations_active_expires_at_idx ON reservations (expires_at) WHERE status = 'active';
+
+COMMIT;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+                                                key VARCHAR(255) PRIMARY KEY,
+                                                request_hash VARCHAR(64) NOT NULL,
+                                                status_code INT NOT NULL DEFAULT 0,
+                                                response BYTEA,
+                                                created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
@@ -0,0 +1 @@
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
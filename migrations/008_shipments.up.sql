@@ -0,0 +1,22 @@
+BEGIN;
+
+ALTER TABLE reservation_lines ADD COLUMN IF NOT EXISTS shipped_quantity INT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS shipments (
+                                         id SERIAL PRIMARY KEY,
+                                         reservation_id INT NOT NULL REFERENCES reservations(id) ON DELETE CASCADE,
+                                         created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE TABLE IF NOT EXISTS shipment_lines (
+                                              id SERIAL PRIMARY KEY,
+                                              shipment_id INT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+                                              warehouse_id INT REFERENCES warehouses(id) ON DELETE CASCADE,
+                                              product_id INT REFERENCES products(id) ON DELETE CASCADE,
+                                              quantity INT NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS shipments_reservation_id_idx ON shipments (reservation_id);
+CREATE INDEX IF NOT EXISTS shipment_lines_shipment_id_idx ON shipment_lines (shipment_id);
+
+COMMIT;
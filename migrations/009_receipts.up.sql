@@ -0,0 +1,20 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS receipts (
+                                        id SERIAL PRIMARY KEY,
+                                        number VARCHAR(255) UNIQUE NOT NULL,
+                                        warehouse_id INT NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+                                        supplier_ref VARCHAR(255) NOT NULL DEFAULT '',
+                                        created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE TABLE IF NOT EXISTS receipt_lines (
+                                             id SERIAL PRIMARY KEY,
+                                             receipt_id INT NOT NULL REFERENCES receipts(id) ON DELETE CASCADE,
+                                             product_id INT REFERENCES products(id) ON DELETE CASCADE,
+                                             quantity INT NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS receipt_lines_receipt_id_idx ON receipt_lines (receipt_id);
+
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+
+ALTER TABLE warehouse_product ADD COLUMN IF NOT EXISTS in_transit_quantity INT NOT NULL DEFAULT 0 CHECK (in_transit_quantity >= 0);
+
+CREATE TABLE IF NOT EXISTS transfers (
+                                         id SERIAL PRIMARY KEY,
+                                         source_warehouse_id INT NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+                                         destination_warehouse_id INT NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+                                         status VARCHAR(20) NOT NULL DEFAULT 'created',
+                                         created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+                                         updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+                                         CHECK (source_warehouse_id <> destination_warehouse_id)
+    );
+
+CREATE TABLE IF NOT EXISTS transfer_lines (
+                                              id SERIAL PRIMARY KEY,
+                                              transfer_id INT NOT NULL REFERENCES transfers(id) ON DELETE CASCADE,
+                                              product_id INT REFERENCES products(id) ON DELETE CASCADE,
+                                              quantity INT NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS transfers_status_idx ON transfers (status);
+CREATE INDEX IF NOT EXISTS transfer_lines_transfer_id_idx ON transfer_lines (transfer_id);
+
+COMMIT;
@@ -0,0 +1,31 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+                                               id BIGSERIAL PRIMARY KEY,
+                                               warehouse_id INT NOT NULL,
+                                               product_id INT NOT NULL,
+                                               type VARCHAR(20) NOT NULL,
+                                               quantity_delta INT NOT NULL DEFAULT 0,
+                                               reserved_delta INT NOT NULL DEFAULT 0,
+                                               in_transit_delta INT NOT NULL DEFAULT 0,
+                                               actor VARCHAR(255) NOT NULL DEFAULT '',
+                                               request_id VARCHAR(255) NOT NULL DEFAULT '',
+                                               created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE INDEX IF NOT EXISTS stock_movements_warehouse_product_idx ON stock_movements (warehouse_id, product_id, created_at);
+CREATE INDEX IF NOT EXISTS stock_movements_product_idx ON stock_movements (product_id, created_at);
+CREATE INDEX IF NOT EXISTS stock_movements_created_at_idx ON stock_movements (created_at);
+
+-- Movements are append-only
+CREATE OR REPLACE FUNCTION stock_movements_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'stock_movements is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS stock_movements_append_only ON stock_movements;
+CREATE TRIGGER stock_movements_append_only BEFORE UPDATE OR DELETE ON stock_movements
+    FOR EACH ROW EXECUTE FUNCTION stock_movements_append_only();
+
+COMMIT;
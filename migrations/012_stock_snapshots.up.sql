@@ -0,0 +1,13 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS stock_snapshots (
+                                               snapshot_at TIMESTAMP NOT NULL,
+                                               warehouse_id INT NOT NULL,
+                                               product_id INT NOT NULL,
+                                               quantity INT NOT NULL,
+                                               reserved_quantity INT NOT NULL,
+                                               in_transit_quantity INT NOT NULL,
+                                               PRIMARY KEY (snapshot_at, warehouse_id, product_id)
+    );
+
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+
+ALTER TABLE stock_movements ADD COLUMN IF NOT EXISTS reason VARCHAR(30) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS stocktakes (
+                                          id SERIAL PRIMARY KEY,
+                                          warehouse_id INT NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+                                          status VARCHAR(20) NOT NULL DEFAULT 'open',
+                                          created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+                                          updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE TABLE IF NOT EXISTS stocktake_lines (
+                                               id SERIAL PRIMARY KEY,
+                                               stocktake_id INT NOT NULL REFERENCES stocktakes(id) ON DELETE CASCADE,
+                                               product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+                                               counted_quantity INT NOT NULL CHECK (counted_quantity >= 0),
+                                               reason VARCHAR(30) NOT NULL,
+                                               UNIQUE (stocktake_id, product_id)
+    );
+
+-- A warehouse has at most one open stocktake
+CREATE UNIQUE INDEX IF NOT EXISTS stocktakes_open_warehouse_idx ON stocktakes (warehouse_id) WHERE status = 'open';
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+ALTER TABLE warehouse_product ADD COLUMN IF NOT EXISTS min_level INT NOT NULL DEFAULT 0 CHECK (min_level >= 0);
+ALTER TABLE warehouse_product ADD COLUMN IF NOT EXISTS reorder_point INT NOT NULL DEFAULT 0 CHECK (reorder_point >= 0);
+
+CREATE TABLE IF NOT EXISTS stock_alerts (
+                                            id SERIAL PRIMARY KEY,
+                                            warehouse_id INT NOT NULL,
+                                            product_id INT NOT NULL,
+                                            level VARCHAR(20) NOT NULL,
+                                            available INT NOT NULL,
+                                            threshold INT NOT NULL,
+                                            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+                                            updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+                                            resolved_at TIMESTAMP
+    );
+
+-- A warehouse product has at most one open alert
+CREATE UNIQUE INDEX IF NOT EXISTS stock_alerts_open_idx ON stock_alerts (warehouse_id, product_id) WHERE resolved_at IS NULL;
+
+COMMIT;
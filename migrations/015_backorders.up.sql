@@ -0,0 +1,29 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS backorders (
+                                          id SERIAL PRIMARY KEY,
+                                          reservation_id INT NOT NULL REFERENCES reservations(id) ON DELETE CASCADE,
+                                          warehouse_id INT NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+                                          product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+                                          quantity INT NOT NULL CHECK (quantity > 0),
+                                          filled_quantity INT NOT NULL DEFAULT 0 CHECK (filled_quantity >= 0 AND filled_quantity <= quantity),
+                                          status VARCHAR(20) NOT NULL DEFAULT 'pending',
+                                          created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+                                          updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+-- Pending backorders are filled in FIFO order per warehouse and product
+CREATE INDEX IF NOT EXISTS backorders_pending_idx ON backorders (warehouse_id, product_id, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS backorders_reservation_idx ON backorders (reservation_id);
+
+-- Outbox of notification events, consumers poll it by id
+CREATE TABLE IF NOT EXISTS events (
+                                      id BIGSERIAL PRIMARY KEY,
+                                      type VARCHAR(50) NOT NULL,
+                                      payload JSONB NOT NULL,
+                                      created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE INDEX IF NOT EXISTS events_type_idx ON events (type, id);
+
+COMMIT;
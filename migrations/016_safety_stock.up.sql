@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Safety stock can't be reserved, NULL on warehouse_product falls back to the warehouse default
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS safety_stock INT NOT NULL DEFAULT 0 CHECK (safety_stock >= 0);
+ALTER TABLE warehouse_product ADD COLUMN IF NOT EXISTS safety_stock INT CHECK (safety_stock >= 0);
+
+COMMIT;
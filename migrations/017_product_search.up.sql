@@ -0,0 +1,12 @@
+BEGIN;
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Trigram indexes serve fuzzy matching of names and codes and prefix matching of codes
+CREATE INDEX IF NOT EXISTS products_name_trgm_idx ON products USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS products_code_trgm_idx ON products USING GIN (code gin_trgm_ops);
+
+-- Full-text index serves matching of whole words of names in any order
+CREATE INDEX IF NOT EXISTS products_name_fts_idx ON products USING GIN (to_tsvector('simple', name));
+
+COMMIT;
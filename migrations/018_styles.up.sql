@@ -0,0 +1,18 @@
+BEGIN;
+
+-- A style is a product article, its variants are products that differ by size and color
+CREATE TABLE IF NOT EXISTS styles (
+                                      id SERIAL PRIMARY KEY,
+                                      article VARCHAR(50) UNIQUE NOT NULL,
+                                      name VARCHAR(255) NOT NULL,
+                                      size_grid VARCHAR(50) NOT NULL DEFAULT ''
+    );
+
+-- Products without a style are standalone, a style with variants can't be deleted
+ALTER TABLE products ADD COLUMN IF NOT EXISTS style_id INT REFERENCES styles(id);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS color VARCHAR(50) NOT NULL DEFAULT '';
+
+-- A style has one variant per size and color
+CREATE UNIQUE INDEX IF NOT EXISTS products_style_variant_idx ON products (style_id, size, color) WHERE style_id IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Barcodes are GTIN-8, GTIN-12, GTIN-13 or GTIN-14, check digits are validated by the service
+CREATE TABLE IF NOT EXISTS product_barcodes (
+                                                barcode VARCHAR(14) PRIMARY KEY CHECK (barcode ~ '^([0-9]{8}|[0-9]{12,14})$'),
+                                                product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+                                                created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE INDEX IF NOT EXISTS product_barcodes_product_idx ON product_barcodes (product_id);
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+-- Stock quantities are kept in the base unit of the product
+ALTER TABLE products ADD COLUMN IF NOT EXISTS unit VARCHAR(20) NOT NULL DEFAULT 'pcs';
+
+-- A pack holds quantity base units of the product, e.g. a box of 12
+CREATE TABLE IF NOT EXISTS product_packs (
+                                             product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+                                             name VARCHAR(20) NOT NULL,
+                                             quantity INT NOT NULL CHECK (quantity > 0),
+                                             PRIMARY KEY (product_id, name)
+    );
+
+COMMIT;
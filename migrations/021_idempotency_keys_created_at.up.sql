@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Expired keys are deleted by created_at
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+
+COMMIT;
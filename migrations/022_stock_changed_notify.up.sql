@@ -0,0 +1,16 @@
+BEGIN;
+
+-- Stock changes are announced on the stock_changed channel as "warehouse_id:product_id",
+-- notifications are delivered on commit and duplicates of a transaction are merged
+CREATE OR REPLACE FUNCTION warehouse_product_notify() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('stock_changed', NEW.warehouse_id || ':' || NEW.product_id);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS warehouse_product_notify ON warehouse_product;
+CREATE TRIGGER warehouse_product_notify AFTER INSERT OR UPDATE ON warehouse_product
+    FOR EACH ROW EXECUTE FUNCTION warehouse_product_notify();
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Request that holds the key, a request that takes over an abandoned key becomes its owner
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS owner VARCHAR(64) NOT NULL DEFAULT '';
+
+COMMIT;